@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ACCESS_FILE is the name of the file in a category's directory describing
+// who may view it; categories without one inherit that of their parent
+const ACCESS_FILE = ".visibility"
+
+// visibility levels of a category
+const (
+	ACCESS_PUBLIC        = "public"        // anyone
+	ACCESS_AUTHENTICATED = "authenticated" // any logged-in user
+	ACCESS_USERS         = "users"         // the listed users and admins
+)
+
+// Access describes who may view a category, its subcategories and papers;
+// it's stored as a single line in ACCESS_FILE, e.g. "users alice,bob"
+type Access struct {
+	Level string
+	Users []string
+}
+
+func (access *Access) String() string {
+	if access.Level == ACCESS_USERS {
+		return access.Level + " " + strings.Join(access.Users, ",")
+	}
+	return access.Level
+}
+
+// parseAccess parses the contents of an ACCESS_FILE
+func parseAccess(s string) (*Access, error) {
+	v := strings.Fields(s)
+	if len(v) == 0 {
+		return nil, fmt.Errorf("empty %s", ACCESS_FILE)
+	}
+	access := &Access{Level: v[0]}
+	switch access.Level {
+	case ACCESS_PUBLIC, ACCESS_AUTHENTICATED:
+	case ACCESS_USERS:
+		if len(v) > 1 {
+			access.Users = splitList(strings.Join(v[1:], ""))
+		}
+	default:
+		return nil, fmt.Errorf("%q is not a valid visibility "+
+			"(public, authenticated, users)", access.Level)
+	}
+	return access, nil
+}
+
+// loadAccess reads the ACCESS_FILE of every category in the papers.List set;
+// an unreadable or invalid file is recorded as a load error and its category
+// made visible to admins only, rather than falling back to public; callers
+// hold the lock
+func (papers *Papers) loadAccess() error {
+	papers.Access = make(map[string]*Access)
+	for category := range papers.List {
+		path := filepath.Join(papers.Path, category, ACCESS_FILE)
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var access *Access
+		if err == nil {
+			access, err = parseAccess(string(b))
+		}
+		if err != nil {
+			papers.loadError(path, err)
+			access = &Access{Level: ACCESS_USERS}
+		}
+		papers.Access[category] = access
+	}
+	return nil
+}
+
+// SetAccess sets the visibility of category, writing its ACCESS_FILE; a nil
+// access removes the file so the category inherits that of its parent
+func (papers *Papers) SetAccess(category string, access *Access) error {
+	papers.Lock()
+	defer papers.Unlock()
+
+	if _, exists := papers.List[category]; exists != true {
+		return fmt.Errorf("category %q does not exist in the set\n", category)
+	}
+	path := filepath.Join(papers.Path, category, ACCESS_FILE)
+	if access == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(papers.Access, category)
+		return nil
+	}
+	if err := ioutil.WriteFile(path, []byte(access.String()+"\n"),
+		0644); err != nil {
+		return err
+	}
+	papers.Access[category] = access
+	return nil
+}
+
+// getAccess returns the visibility of category, inherited from the nearest
+// ancestor with an ACCESS_FILE, or public if there is none; callers hold the
+// lock
+func (papers *Papers) getAccess(category string) *Access {
+	for n := category; n != "." && n != ""; n = filepath.Dir(n) {
+		if access, exists := papers.Access[n]; exists {
+			return access
+		}
+	}
+	return &Access{Level: ACCESS_PUBLIC}
+}
+
+// GetAccess returns the visibility of category, inherited from the nearest
+// ancestor with an ACCESS_FILE, or public if there is none
+func (papers *Papers) GetAccess(category string) *Access {
+	papers.RLock()
+	defer papers.RUnlock()
+	return papers.getAccess(category)
+}
+
+// canView reports whether u (nil for anonymous clients) may view category
+func (papers *Papers) canView(category string, u *User) bool {
+	access := papers.GetAccess(category)
+	switch access.Level {
+	case ACCESS_PUBLIC:
+		return true
+	case ACCESS_AUTHENTICATED:
+		return u != nil
+	case ACCESS_USERS:
+		if u == nil {
+			return false
+		}
+		if u.CanManage() {
+			return true
+		}
+		for _, name := range access.Users {
+			if name == u.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// viewer returns a function reporting whether the client making the request
+// may view a category, accounting for both category visibility and, for API
+// tokens, the token's category restrictions
+func (papers *Papers) viewer(r *http.Request) func(category string) bool {
+	session := currentSession(r)
+	var u *User
+	if session != nil {
+		u = session.User
+	}
+	return func(category string) bool {
+		if session != nil && !session.Allowed(category) {
+			return false
+		}
+		return papers.canView(category, u)
+	}
+}
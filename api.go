@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// APIPaper is the JSON representation of a paper returned by the API
+type APIPaper struct {
+	Key      string    `json:"key"`
+	Category string    `json:"category"`
+	Title    string    `json:"title"`
+	Authors  []string  `json:"authors,omitempty"`
+	Year     string    `json:"year,omitempty"`
+	Journal  string    `json:"journal,omitempty"`
+	DOI      string    `json:"doi,omitempty"`
+	Added    time.Time `json:"added"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Download string    `json:"download"`
+}
+
+// newAPIPaper returns the JSON representation of the paper stored at key
+func newAPIPaper(key string, paper *Paper) APIPaper {
+	p := APIPaper{
+		Key:      key,
+		Category: filepath.Dir(key),
+		Title:    getTitle(paper),
+		Year:     paper.Meta.PubYear,
+		Journal:  normalizeStr(paper.Meta.Journal),
+		DOI:      paper.Meta.DOI,
+		Added:    paper.Added,
+		SHA256:   paper.SHA256,
+		Download: basePath + "/download/" + key,
+	}
+	for _, c := range paper.Meta.Contributors {
+		p.Authors = append(p.Authors, strings.TrimSpace(c.FirstName+" "+
+			c.LastName))
+	}
+	return p
+}
+
+// writeJSON writes v to w as JSON with the provided status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes err to w as a JSON object with the provided status code
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// APIPapersHandler lists papers as JSON, accepting the sorting, filtering and
+// pagination parameters of the index, e.g. /api/papers?sort=added&order=desc
+func (papers *Papers) APIPapersHandler(w http.ResponseWriter, r *http.Request) {
+	session := authorize(w, r, ROLE_VIEWER)
+	if session == nil {
+		return
+	}
+	q := parseQuery(r)
+	q.allowed = papers.viewer(r)
+	listings, pages := papers.Query(q)
+
+	res := struct {
+		Pages  Pages      `json:"pages"`
+		Papers []APIPaper `json:"papers"`
+	}{Pages: pages, Papers: []APIPaper{}}
+	for _, l := range listings {
+		res.Papers = append(res.Papers, newAPIPaper(l.Key, l.Paper))
+	}
+	writeJSON(w, http.StatusOK, &res)
+}
+
+// APIAddHandler downloads the paper described by the input (DOI or URL) and
+// category form values, returning it as JSON
+func (papers *Papers) APIAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	session := authorize(w, r, ROLE_CONTRIBUTOR)
+	if session == nil {
+		return
+	}
+	input := strings.TrimSpace(r.PostFormValue("input"))
+	category := strings.Trim(strings.Replace(r.PostFormValue("category"),
+		"..", "", -1), "/.")
+	if input == "" || category == "" {
+		writeJSONError(w, http.StatusBadRequest,
+			errors.New("input and category are required"))
+		return
+	}
+	if !session.Allowed(category) {
+		writeJSONError(w, http.StatusForbidden,
+			fmt.Errorf("token not permitted in category %q", category))
+		return
+	}
+
+	// categories hidden from the client respond as though they don't exist
+	visible := papers.viewer(r)
+	papers.RLock()
+	_, exists := papers.List[category]
+	papers.RUnlock()
+	if exists == false || visible(category) == false {
+		writeJSONError(w, http.StatusNotFound,
+			fmt.Errorf("category %q does not exist", category))
+		return
+	}
+
+	paper, err := papers.ProcessAddPaperInput(category, input)
+	if err != nil {
+		writeJSONError(w, addErrorStatus(err), hideDuplicate(err, visible))
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIPaper(filepath.Join(category,
+		paper.PaperName+".pdf"), paper))
+}
+
+// addErrorStatus returns the status of an APIAddHandler response reporting
+// err: 409 for a paper already in the library, 400 for invalid input and 502
+// for a failure of the remote endpoints the paper was fetched from
+func addErrorStatus(err error) int {
+	var dup *DuplicateError
+	var input *InputError
+	switch {
+	case errors.As(err, &dup):
+		return http.StatusConflict
+	case errors.As(err, &input):
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPDF is a minimal document which passes validatePDF
+const testPDF = "%PDF-1.4\n1 0 obj\n<<>>\nendobj\nstartxref\n0\n%%EOF\n"
+
+func TestAPIAddStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-api-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "Mathematics"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	setUsers(t, map[string]Role{"alice": ROLE_CONTRIBUTOR})
+
+	// the test server is local, which the outbound client would refuse
+	defer func(c *http.Client, n int64) { client, maxSize = c, n }(client,
+		maxSize)
+	client, maxSize = &http.Client{}, MAX_SIZE
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.URL.Path != "/paper.pdf" {
+			http.Error(w, "upstream failure", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte(testPDF))
+	}))
+	defer srv.Close()
+
+	// the library already holds the test server's paper
+	b := sha256.Sum256([]byte(testPDF))
+	sum := hex.EncodeToString(b[:])
+	papers := &Papers{Path: dir, List: map[string]map[string]*Paper{
+		"Mathematics": make(map[string]*Paper),
+	}}
+	kept := &Paper{PaperName: "doe2020", SHA256: sum}
+	papers.List["Mathematics"]["Mathematics/doe2020.pdf"] = kept
+	papers.index("Mathematics/doe2020.pdf", kept)
+
+	for _, tt := range []struct {
+		input string
+		code  int
+	}{
+		{"not a doi", http.StatusBadRequest},
+		{"http://", http.StatusBadRequest},
+		{srv.URL + "/paper.pdf", http.StatusConflict},
+		{srv.URL + "/missing", http.StatusBadGateway},
+	} {
+		session := newSession("alice")
+		form := url.Values{"input": {tt.input}, "category": {"Mathematics"},
+			"csrf": {session.CSRF}}
+		r := sessionRequest(http.MethodPost, "/api/add", form, session)
+		w := httptest.NewRecorder()
+		papers.APIAddHandler(w, r)
+		if w.Code != tt.code {
+			t.Errorf("add %q: status %d, want %d (%s)", tt.input, w.Code,
+				tt.code, w.Body)
+		}
+	}
+}
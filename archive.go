@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Export writes the papers of category (or the whole library if empty) and
+// its subcategories to w as a tar archive of the library's own layout: each
+// category's directory, its visibility file, and each paper's PDF and XML
+// sidecar
+func (papers *Papers) Export(w io.Writer, category string) error {
+	papers.RLock()
+	defer papers.RUnlock()
+
+	if _, exists := papers.List[category]; category != "" && exists == false {
+		return fmt.Errorf("category %q does not exist in the set", category)
+	}
+	var categories []string
+	for c := range papers.List {
+		if category == "" || c == category ||
+			strings.HasPrefix(c, category+"/") {
+			categories = append(categories, c)
+		}
+	}
+	sort.Strings(categories)
+
+	tw := tar.NewWriter(w)
+	for _, c := range categories {
+		if err := addToTar(tw, filepath.Join(papers.Path, c), c); err != nil {
+			return err
+		}
+		if _, exists := papers.Access[c]; exists {
+			if err := addToTar(tw, filepath.Join(papers.Path, c, ACCESS_FILE),
+				filepath.Join(c, ACCESS_FILE)); err != nil {
+				return err
+			}
+		}
+
+		var keys []string
+		for key := range papers.List[c] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			paper := papers.List[c][key]
+			if err := addToTar(tw, paper.PaperPath, key); err != nil {
+				return err
+			}
+			if paper.MetaPath == "" {
+				continue
+			}
+			if err := addToTar(tw, paper.MetaPath, filepath.Join(c,
+				paper.PaperName+".meta.xml")); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// addToTar writes the file or directory at path to tw as name
+func addToTar(tw *tar.Writer, path string, name string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Skipped is a paper of an archive which Import didn't add
+type Skipped struct {
+	Key string
+	Err error // why the PDF isn't valid, or nil if it's a duplicate
+}
+
+// Import adds the papers of a tar archive written by Export, optionally
+// compressed with gzip, to the library beneath category (or at the top level
+// if empty); papers duplicating one already in the library, or which aren't
+// valid PDFs, are skipped, and those whose names are taken are renamed. The
+// keys of the added papers are returned along with the skipped papers
+func (papers *Papers) Import(r io.Reader, category string) ([]string,
+	[]Skipped, error) {
+
+	// the archive is staged outside the library, as sidecars and visibility
+	// files may precede or follow the papers they belong to
+	staging, err := ioutil.TempDir("", "crane-import-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f &&
+		magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	var pdfs, dirs []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		// reject names which would escape the staging directory
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." ||
+			strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, nil, fmt.Errorf("archive entry %q is outside of "+
+				"the library", hdr.Name)
+		}
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			dirs = append(dirs, name)
+			continue
+		case hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA:
+			continue
+		case filepath.Ext(name) == ".pdf":
+			pdfs = append(pdfs, name)
+		case strings.HasSuffix(name, ".meta.xml"),
+			filepath.Base(name) == ACCESS_FILE:
+		default:
+			continue
+		}
+		dir := filepath.Dir(name)
+		if dir == "." && category == "" {
+			return nil, nil, fmt.Errorf("archive entry %q is not in a "+
+				"category", hdr.Name)
+		}
+		dirs = append(dirs, dir)
+		if err := os.MkdirAll(filepath.Join(staging, dir),
+			os.ModePerm); err != nil {
+			return nil, nil, err
+		}
+		f, err := os.Create(filepath.Join(staging, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = io.Copy(f, tr)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// create every category, applying the archive's visibility to those
+	// which don't already have their own
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		dest := filepath.Join(category, dir)
+		if dest == "." {
+			continue
+		}
+		if err := papers.NewCategory(dest); err != nil {
+			return nil, nil, err
+		}
+		src := filepath.Join(staging, dir, ACCESS_FILE)
+		b, err := ioutil.ReadFile(src)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		access, err := parseAccess(string(b))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", filepath.Join(dir,
+				ACCESS_FILE), err)
+		}
+		papers.RLock()
+		_, exists := papers.Access[dest]
+		papers.RUnlock()
+		if exists {
+			continue
+		}
+		if err := papers.SetAccess(dest, access); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var added []string
+	var skipped []Skipped
+	sort.Strings(pdfs)
+	for _, name := range pdfs {
+		// e.g. an HTML error page saved as a PDF by another tool
+		path := filepath.Join(staging, name)
+		if err := validatePDF(path); err != nil {
+			skipped = append(skipped, Skipped{filepath.Join(category, name),
+				err})
+			continue
+		}
+		key, err := papers.importPaper(path,
+			filepath.Join(category, filepath.Dir(name)))
+		if err != nil {
+			return added, skipped, fmt.Errorf("%s: %v", name, err)
+		}
+		if key == "" {
+			skipped = append(skipped, Skipped{Key: filepath.Join(category,
+				name)})
+		} else {
+			added = append(added, key)
+		}
+	}
+	return added, skipped, nil
+}
+
+// importPaper moves the PDF at path, and its XML sidecar if any, into
+// category, returning its key, or an empty key if it duplicates a paper
+// already in the library
+func (papers *Papers) importPaper(path string, category string) (string,
+	error) {
+	name := strings.TrimSuffix(filepath.Base(path), ".pdf")
+	metaPath := filepath.Join(filepath.Dir(path), name+".meta.xml")
+
+	var meta Meta
+	if b, err := ioutil.ReadFile(metaPath); err == nil {
+		if err := xml.Unmarshal(b, &meta); err != nil {
+			return "", err
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	} else {
+		metaPath = ""
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	if papers.findDuplicate(sum, meta.DOI) != "" {
+		return "", nil
+	}
+
+	name = papers.getUniqueName(category, name)
+	dest := filepath.Join(papers.Path, category, name+".pdf")
+	if err := renameFile(path, dest); err != nil {
+		return "", err
+	}
+	if metaPath != "" {
+		if err := renameFile(metaPath, filepath.Join(papers.Path, category,
+			name+".meta.xml")); err != nil {
+			return "", err
+		}
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return "", err
+	}
+	if err := papers.findPapersWalk(dest, info, nil); err != nil {
+		return "", err
+	}
+	return filepath.Join(category, name+".pdf"), nil
+}
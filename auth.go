@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is the level of access granted to a user; each role includes the
+// permissions of those below it
+type Role int
+
+const (
+	ROLE_NONE        Role = iota // anonymous; the public index only
+	ROLE_VIEWER                  // may view the admin pages
+	ROLE_CONTRIBUTOR             // may add papers and categories
+	ROLE_ADMIN                   // may delete, move and rename, manage users
+)
+
+var roleNames = map[Role]string{
+	ROLE_VIEWER:      "viewer",
+	ROLE_CONTRIBUTOR: "contributor",
+	ROLE_ADMIN:       "admin",
+}
+
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+// parseRole returns the Role named by s, e.g. contributor
+func parseRole(s string) (Role, error) {
+	for role, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return role, nil
+		}
+	}
+	return ROLE_NONE, fmt.Errorf("%q is not a valid role (viewer, contributor, admin)", s)
+}
+
+type User struct {
+	Name string
+	Role Role
+	Hash []byte // bcrypt hash of the user's password
+}
+
+// CanAdd reports whether the user may add papers and categories
+func (u *User) CanAdd() bool {
+	return u != nil && u.Role >= ROLE_CONTRIBUTOR
+}
+
+// CanManage reports whether the user may delete, move and rename papers and
+// categories and manage other users
+func (u *User) CanManage() bool {
+	return u != nil && u.Role >= ROLE_ADMIN
+}
+
+// Users is the set of accounts permitted to access the admin endpoints, stored
+// one per line as name:role:hash in the file at Path
+type Users struct {
+	sync.RWMutex
+	List map[string]*User
+	Path string
+}
+
+// Load populates the users set from the file at users.Path; a missing file is
+// an empty set
+func (users *Users) Load() error {
+	users.Lock()
+	defer users.Unlock()
+
+	users.List = make(map[string]*User)
+	f, err := os.Open(users.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v := strings.SplitN(line, ":", 3)
+		if len(v) != 3 {
+			return fmt.Errorf("%s:%d: expected name:role:hash", users.Path, n)
+		}
+		role, err := parseRole(v[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", users.Path, n, err)
+		}
+		users.List[v[0]] = &User{Name: v[0], Role: role, Hash: []byte(v[2])}
+	}
+	return s.Err()
+}
+
+// save writes the users set to users.Path by way of a temporary file so a
+// failed write doesn't truncate existing accounts; callers hold the lock
+func (users *Users) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(users.Path), ".users-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, user := range users.sorted() {
+		if _, err := fmt.Fprintf(tmp, "%s:%s:%s\n", user.Name, user.Role,
+			user.Hash); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), users.Path)
+}
+
+// sorted returns the users of the set ordered by name; callers hold the lock
+func (users *Users) sorted() []*User {
+	list := make([]*User, 0, len(users.List))
+	for _, user := range users.List {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Sorted returns the users of the set ordered by name
+func (users *Users) Sorted() []*User {
+	users.RLock()
+	defer users.RUnlock()
+	return users.sorted()
+}
+
+// SetUser adds a user or updates an existing user's role and, if provided,
+// password, persisting the change to users.Path
+func (users *Users) SetUser(name string, password string, role Role) error {
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		return fmt.Errorf("%q is not a valid username", name)
+	}
+	if role == ROLE_NONE {
+		return errors.New("a role is required")
+	}
+	if users.Path == "" {
+		return errors.New("no users file configured (see -users)")
+	}
+	users.Lock()
+	defer users.Unlock()
+
+	user, exists := users.List[name]
+	if exists == false {
+		if password == "" {
+			return fmt.Errorf("a password is required for new user %q", name)
+		}
+		user = &User{Name: name}
+	}
+	if exists && user.Role == ROLE_ADMIN && role != ROLE_ADMIN &&
+		users.admins() == 1 {
+		return fmt.Errorf("user %q is the last admin", name)
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password),
+			bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.Hash = hash
+	}
+	user.Role = role
+	users.List[name] = user
+	return users.save()
+}
+
+// DeleteUser removes a user from the set, persisting the change to users.Path
+func (users *Users) DeleteUser(name string) error {
+	users.Lock()
+	defer users.Unlock()
+
+	user, exists := users.List[name]
+	if exists == false {
+		return fmt.Errorf("user %q does not exist", name)
+	}
+	if user.Role == ROLE_ADMIN && users.admins() == 1 {
+		return fmt.Errorf("user %q is the last admin", name)
+	}
+	delete(users.List, name)
+	return users.save()
+}
+
+// admins returns the number of users with the admin role; callers hold the
+// lock
+func (users *Users) admins() int {
+	var n int
+	for _, user := range users.List {
+		if user.Role == ROLE_ADMIN {
+			n++
+		}
+	}
+	return n
+}
+
+// Authenticate returns the user matching the provided credentials, or nil
+func (users *Users) Authenticate(name string, password string) *User {
+	users.RLock()
+	user, exists := users.List[name]
+	users.RUnlock()
+	if exists == false {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(user.Hash, []byte(password)) != nil {
+		return nil
+	}
+	return user
+}
+
+// openAccess reports whether no accounts are configured, in which case every
+// client is treated as an admin
+func openAccess() bool {
+	users.RLock()
+	defer users.RUnlock()
+	return len(users.List) == 0 && (user == "" || pass == "")
+}
+
+// checkCredentials returns the user matching the provided credentials, or
+// nil; the single -user/-pass pair is honored if no users file exists
+func checkCredentials(name string, password string) *User {
+	users.RLock()
+	n := len(users.List)
+	users.RUnlock()
+
+	if n == 0 {
+		if user != "" && pass != "" &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(name)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1 {
+			return &User{Name: user, Role: ROLE_ADMIN}
+		}
+		return nil
+	}
+	return users.Authenticate(name, password)
+}
+
+// lookupUser returns the named user as of now, reflecting role changes and
+// deletions made since their session began, or nil
+func lookupUser(name string) *User {
+	users.RLock()
+	defer users.RUnlock()
+
+	if len(users.List) == 0 {
+		if user != "" && pass != "" && name == user {
+			return &User{Name: user, Role: ROLE_ADMIN}
+		}
+		return nil
+	}
+	return users.List[name]
+}
+
+// authorize returns the session of the user making the request if they hold
+// at least role and, for state-changing requests, provided its CSRF token;
+// otherwise the client is sent to the login page or an error response is
+// written and nil returned
+func authorize(w http.ResponseWriter, r *http.Request, role Role) *Session {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") &&
+		!openAccess() {
+		return authorizeToken(w, strings.TrimPrefix(h, "Bearer "), role)
+	}
+
+	session := sessions.Get(r)
+	if openAccess() {
+		// anonymous sessions still carry CSRF tokens, so other sites cannot
+		// make changes through the browser of someone visiting them
+		if session == nil {
+			v := *sessions.New(w, r, "")
+			session = &v
+		}
+		session.User = &User{Role: ROLE_ADMIN}
+	} else if session != nil {
+		session.User = lookupUser(session.Name)
+	}
+
+	if session == nil || session.User == nil {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()),
+				http.StatusSeeOther)
+		} else {
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+		}
+		return nil
+	}
+	if session.User.Role < role {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return nil
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+		!session.validCSRF(r) {
+		http.Error(w, "invalid or missing CSRF token", http.StatusForbidden)
+		return nil
+	}
+	return session
+}
+
+// authorizeToken returns a session acting as the owner of the API token if
+// the token grants at least role; browsers don't send tokens on their own, so
+// no CSRF token is required
+func authorizeToken(w http.ResponseWriter, secret string, role Role) *Session {
+	session := tokenSession(secret)
+	if session == nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="crane"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return nil
+	}
+	if session.User.Role < role {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return nil
+	}
+	return session
+}
+
+// tokenSession returns a session acting as the owner of the API token, or nil
+// if the token or its owner doesn't exist
+func tokenSession(secret string) *Session {
+	token := tokens.Authenticate(secret)
+	if token == nil {
+		return nil
+	}
+	u := lookupUser(token.Owner)
+	if u == nil {
+		return nil
+	}
+
+	// the token's scopes may narrow, but never widen, its owner's role
+	effective := &User{Name: u.Name, Role: u.Role}
+	if token.Role() < effective.Role {
+		effective.Role = token.Role()
+	}
+	return &Session{Name: u.Name, User: effective, Token: token}
+}
+
+// currentSession returns the session of the client making the request, or nil
+// for anonymous clients; unlike authorize, nothing is required of the client
+// and no response is written
+func currentSession(r *http.Request) *Session {
+	if openAccess() {
+		return &Session{User: &User{Role: ROLE_ADMIN}}
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return tokenSession(strings.TrimPrefix(h, "Bearer "))
+	}
+	session := sessions.Get(r)
+	if session == nil {
+		return nil
+	}
+	if session.User = lookupUser(session.Name); session.User == nil {
+		return nil
+	}
+	return session
+}
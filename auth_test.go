@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setUsers replaces the users set with accounts of the given roles for the
+// duration of the test
+func setUsers(t *testing.T, roles map[string]Role) {
+	users.Lock()
+	prev := users.List
+	users.List = make(map[string]*User)
+	for name, role := range roles {
+		users.List[name] = &User{Name: name, Role: role}
+	}
+	users.Unlock()
+	t.Cleanup(func() {
+		users.Lock()
+		users.List = prev
+		users.Unlock()
+	})
+}
+
+// newSession begins a session for the named user
+func newSession(name string) *Session {
+	return sessions.New(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/login", nil), name)
+}
+
+// sessionRequest returns a request with form as its body, made within session,
+// or by an anonymous client if it's nil
+func sessionRequest(method string, target string, form url.Values,
+	session *Session) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if session != nil {
+		r.AddCookie(&http.Cookie{Name: SESSION_COOKIE,
+			Value: sessions.sign(session.ID)})
+	}
+	return r
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	setUsers(t, map[string]Role{
+		"viewer":      ROLE_VIEWER,
+		"contributor": ROLE_CONTRIBUTOR,
+		"admin":       ROLE_ADMIN,
+	})
+
+	for _, tt := range []struct {
+		user   string // empty for anonymous clients
+		method string
+		role   Role
+		code   int // 0 if authorized
+	}{
+		{"viewer", http.MethodGet, ROLE_VIEWER, 0},
+		{"viewer", http.MethodGet, ROLE_CONTRIBUTOR, http.StatusForbidden},
+		{"viewer", http.MethodPost, ROLE_ADMIN, http.StatusForbidden},
+		{"contributor", http.MethodGet, ROLE_VIEWER, 0},
+		{"contributor", http.MethodPost, ROLE_CONTRIBUTOR, 0},
+		{"contributor", http.MethodPost, ROLE_ADMIN, http.StatusForbidden},
+		{"admin", http.MethodPost, ROLE_ADMIN, 0},
+		{"", http.MethodGet, ROLE_VIEWER, http.StatusSeeOther},
+		{"", http.MethodPost, ROLE_VIEWER, http.StatusUnauthorized},
+		{"deleted", http.MethodGet, ROLE_VIEWER, http.StatusSeeOther},
+	} {
+		var session *Session
+		form := url.Values{}
+		if tt.user != "" {
+			session = newSession(tt.user)
+			form.Set("csrf", session.CSRF)
+		}
+		r := sessionRequest(tt.method, "/admin/", form, session)
+		w := httptest.NewRecorder()
+		got := authorize(w, r, tt.role)
+		switch {
+		case tt.code == 0 && got == nil:
+			t.Errorf("%s %s as %q for %v: not authorized (%d)", tt.method,
+				r.URL, tt.user, tt.role, w.Code)
+		case tt.code == 0 && got.User.Name != tt.user:
+			t.Errorf("%s %s as %q for %v: authorized as %q", tt.method,
+				r.URL, tt.user, tt.role, got.User.Name)
+		case tt.code != 0 && got != nil:
+			t.Errorf("%s %s as %q for %v: authorized, want %d", tt.method,
+				r.URL, tt.user, tt.role, tt.code)
+		case tt.code != 0 && w.Code != tt.code:
+			t.Errorf("%s %s as %q for %v: status %d, want %d", tt.method,
+				r.URL, tt.user, tt.role, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAuthorizeRoleChanges(t *testing.T) {
+	setUsers(t, map[string]Role{"alice": ROLE_ADMIN})
+	r := sessionRequest(http.MethodGet, "/admin/users/", nil,
+		newSession("alice"))
+
+	// roles are looked up on every request, so a demotion takes effect
+	// within the session
+	users.Lock()
+	users.List["alice"].Role = ROLE_VIEWER
+	users.Unlock()
+	w := httptest.NewRecorder()
+	if authorize(w, r, ROLE_ADMIN) != nil {
+		t.Fatal("demoted user authorized as admin")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestLoginBackoffPerAddress(t *testing.T) {
+	b := Backoff{List: make(map[string]*failures)}
+
+	// failures from one address don't delay logins for the same user from
+	// another
+	b.Fail(loginKey("192.0.2.1", "alice"))
+	if b.Wait(loginKey("192.0.2.1", "alice")) <= 0 {
+		t.Fatal("failed address and username not delayed")
+	}
+	if d := b.Wait(loginKey("192.0.2.2", "alice")); d > 0 {
+		t.Fatalf("other address delayed %v", d)
+	}
+
+	// the address alone is delayed only after its free failures
+	addr := Backoff{List: make(map[string]*failures), Free: 2}
+	for i := 0; i < 2; i++ {
+		addr.Fail("192.0.2.1")
+		if d := addr.Wait("192.0.2.1"); d > 0 {
+			t.Fatalf("delayed %v after %d failures, want none", d, i+1)
+		}
+	}
+	addr.Fail("192.0.2.1")
+	if addr.Wait("192.0.2.1") <= 0 {
+		t.Fatal("address not delayed after its free failures")
+	}
+}
+
+func TestEditHidesRestrictedCategories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-tokens-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setUsers(t, map[string]Role{"alice": ROLE_ADMIN})
+	defer func(path string) { tokens.Path = path }(tokens.Path)
+	tokens.Path = filepath.Join(dir, "tokens")
+	_, secret, err := tokens.NewToken("alice", "script",
+		[]string{"manage"}, []string{"Shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { templateDir = dir }(templateDir)
+	templateDir = "templates"
+	loadTemplates()
+
+	papers := &Papers{Path: dir, List: map[string]map[string]*Paper{
+		"Shared": {"Shared/open2020.pdf": &Paper{PaperName: "open2020"}},
+		"Hidden": {"Hidden/secret2020.pdf": &Paper{PaperName: "secret2020"}},
+	}}
+	r := httptest.NewRequest(http.MethodGet, "/admin/edit/", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	papers.EditHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "open2020") {
+		t.Error("permitted paper missing from edit page")
+	}
+	for _, s := range []string{"Hidden", "secret2020"} {
+		if strings.Contains(body, s) {
+			t.Errorf("restricted %q listed on edit page", s)
+		}
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Command is a subcommand of the crane binary, e.g. crane add
+type Command struct {
+	Run   func(args []string) error
+	Usage string // arguments, e.g. [-c CATEGORY] DOI|URL...
+	Short string
+}
+
+var commands map[string]Command
+
+// commands is populated at init, as the commands' flag sets refer to it for
+// their usage
+func init() {
+	commands = map[string]Command{
+		"serve":  {serveCommand, "[flags]", "run the web interface (default)"},
+		"add":    {addCommand, "-c CATEGORY DOI|URL...", "download papers into a category"},
+		"ls":     {lsCommand, "[-c CATEGORY] [-sort KEY] [-order asc|desc] [-json]", "list papers"},
+		"mv":     {mvCommand, "PAPER|CATEGORY... DEST", "move papers and categories"},
+		"rm":     {rmCommand, "[-r] PAPER|CATEGORY...", "delete papers and categories"},
+		"export": {exportCommand, "[-c CATEGORY] [-o FILE]", "write papers to a tar archive"},
+		"import": {importCommand, "[-c CATEGORY] FILE", "add papers from a tar archive"},
+		"verify": {verifyCommand, "[-repair]", "check the library for bad files"},
+		"user":   {userCommand, "set NAME ROLE | del NAME | ls", "manage user accounts"},
+		"cookies": {cookiesCommand, "import [-d DOMAIN] FILE|- | ls | clear DOMAIN",
+			"manage cookies of outbound requests"},
+	}
+}
+
+// usage prints the subcommands of the crane binary
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [arguments]\n\n",
+		os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].Short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a "+
+		"command.\n", os.Args[0])
+}
+
+// newFlagSet returns the flag set of the named subcommand, whose usage lists
+// its arguments and flags
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", os.Args[0], name,
+			commands[name].Usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// interspersed reorders args so flags following positional arguments are
+// parsed too, e.g. crane add 10.1000/xyz123 -c Mathematics
+func interspersed(fs *flag.FlagSet, args []string) []string {
+	var flags, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		flags = append(flags, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := fs.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok &&
+				b.IsBoolFlag() {
+				continue
+			}
+			if i+1 < len(args) {
+				i++
+				flags = append(flags, args[i])
+			}
+		}
+	}
+	return append(append(flags, "--"), positional...)
+}
+
+// flags registers the flags locating the library on fs
+func (papers *Papers) flags(fs *flag.FlagSet) {
+	fs.String("config", "", "Path to configuration file (optional)")
+	fs.StringVar(&papers.Path, "path", "./papers",
+		"Absolute or relative path to papers folder")
+}
+
+// Open creates the library at papers.Path if it doesn't exist and populates
+// the papers set from it
+func (papers *Papers) Open() error {
+	var err error
+	if papers.Path, err = filepath.Abs(papers.Path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(papers.Path); os.IsNotExist(err) {
+		if err := os.Mkdir(papers.Path, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	papers.List = make(map[string]map[string]*Paper)
+	stagingDir = filepath.Join(papers.Path, STAGING_DIR)
+	cleanPartials()
+	if err := jar.Open(filepath.Join(papers.Path, COOKIES_FILE)); err != nil {
+		return err
+	}
+	return papers.PopulatePapers()
+}
+
+// fetchFlags are the settings of commands which download papers
+type fetchFlags struct {
+	scihub   string
+	ezproxy  string
+	allowIPs string
+	blockIPs string
+	rules    string
+	maxSizes map[string]*int64  // by source
+	proxies  map[string]*string // by resolver; "" is the default
+}
+
+// flags registers the flags of commands which download papers on fs
+func (fetch *fetchFlags) flags(fs *flag.FlagSet) {
+	fs.StringVar(&fetch.scihub, "sci-hub", "https://sci-hub.hkvisa.net/",
+		"Sci-Hub URL")
+	fs.DurationVar(&timeout, "timeout", TIMEOUT*time.Second,
+		"Time to wait for an outbound connection and its response headers")
+	fs.DurationVar(&idleTimeout, "idle-timeout", IDLE_TIMEOUT*time.Second,
+		"Time an outbound download may go without receiving data")
+	fs.Int64Var(&maxSize, "max-size", MAX_SIZE,
+		"Max size of a downloaded paper in bytes")
+	fs.IntVar(&outbound.Concurrency, "host-concurrency", HOST_CONCURRENCY,
+		"Max outbound requests in flight to a single host")
+	fs.DurationVar(&outbound.Interval, "host-interval",
+		HOST_INTERVAL*time.Millisecond,
+		"Min time between the start of outbound requests to a single host")
+	fs.IntVar(&outbound.Retries, "retries", RETRIES,
+		"Times to retry an outbound request which failed temporarily")
+	fs.StringVar(&fetch.allowIPs, "allow-ips", "", "Comma-separated "+
+		"IPs/CIDR ranges outbound requests may reach despite being private "+
+		"(optional)")
+	fs.StringVar(&fetch.blockIPs, "block-ips", "", "Comma-separated "+
+		"IPs/CIDR ranges outbound requests may not reach, besides private "+
+		"addresses (optional)")
+	fs.StringVar(&ezproxyURL, "ezproxy", "", "EZproxy starting point URL "+
+		"through which to fetch PDF links found on landing pages, e.g. "+
+		"https://login.ezproxy.example.edu/login?url= (optional)")
+	fs.StringVar(&fetch.ezproxy, "ezproxy-domains", "", "Comma-separated "+
+		"publisher domains to fetch through EZproxy (default all)")
+	fs.StringVar(&fetch.rules, "rules", "", "Directory of DOMAIN.rules "+
+		"files locating PDFs on landing pages lacking citation_pdf_url "+
+		"(optional)")
+	fetch.proxies = map[string]*string{"": fs.String("proxy", "",
+		"URL of HTTP or SOCKS5 proxy for outbound requests, e.g. "+
+			"socks5h://127.0.0.1:9050 (default $HTTP_PROXY)")}
+	for _, resolver := range []string{RESOLVER_DOI, RESOLVER_SCIHUB,
+		RESOLVER_PUBLISHER} {
+		fetch.proxies[resolver] = fs.String("proxy-"+resolver, "",
+			"URL of proxy for "+resolver+" requests, or \""+PROXY_DIRECT+
+				"\" (default -proxy)")
+	}
+	fetch.maxSizes = make(map[string]*int64)
+	for name, source := range map[string]string{
+		"max-size-sci-hub":  SOURCE_SCIHUB,
+		"max-size-citation": SOURCE_CITATION,
+		"max-size-direct":   SOURCE_DIRECT,
+		"max-size-rule":     SOURCE_RULE,
+	} {
+		fetch.maxSizes[source] = fs.Int64(name, 0, "Max size of a paper "+
+			"downloaded from "+source+" in bytes (default -max-size)")
+	}
+}
+
+// apply applies the parsed fetch flags to the outbound client
+func (fetch *fetchFlags) apply() error {
+	var err error
+	if scihubURL, err = url.Parse(fetch.scihub); err != nil {
+		return err
+	}
+	for source, n := range fetch.maxSizes {
+		if *n < 0 {
+			return fmt.Errorf("max size for %s must not be negative", source)
+		}
+		maxSizes[source] = *n
+	}
+	if allowedIPs, err = parseIPNets(fetch.allowIPs); err != nil {
+		return fmt.Errorf("allow-ips: %v", err)
+	}
+	if blockedIPs, err = parseIPNets(fetch.blockIPs); err != nil {
+		return fmt.Errorf("block-ips: %v", err)
+	}
+	if ezproxyURL != "" {
+		if u, err := url.Parse(ezproxyURL); err != nil || u.Host == "" {
+			return fmt.Errorf("ezproxy %q is not a URL", ezproxyURL)
+		}
+	}
+	rules = nil
+	if fetch.rules != "" {
+		if rules, err = loadRules(fetch.rules); err != nil {
+			return fmt.Errorf("rules: %v", err)
+		}
+	}
+	ezproxyDomains = nil
+	for _, d := range splitList(fetch.ezproxy) {
+		ezproxyDomains = append(ezproxyDomains,
+			strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), ".")))
+	}
+	for resolver, v := range fetch.proxies {
+		if *v == "" {
+			continue
+		}
+		proxy, err := parseProxy(*v)
+		if err != nil {
+			return err
+		}
+		proxies[resolver] = proxy
+	}
+	if outbound.Concurrency < 1 || outbound.Retries < 0 {
+		return fmt.Errorf("host-concurrency must be positive and retries " +
+			"must not be negative")
+	}
+	http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout = timeout
+	return nil
+}
+
+// addCommand implements the "add" subcommand, downloading papers by DOI or URL
+// into a category, which is created if it doesn't exist
+func addCommand(args []string) error {
+	var papers Papers
+	var fetch fetchFlags
+	var category string
+
+	fs := newFlagSet("add")
+	papers.flags(fs)
+	fetch.flags(fs)
+	fs.StringVar(&category, "c", "", "Category to add papers to")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	category = strings.Trim(strings.Replace(category, "..", "", -1), "/.")
+	if category == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := fetch.apply(); err != nil {
+		return err
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+	if err := papers.NewCategory(category); err != nil {
+		return err
+	}
+
+	var failed int
+	for _, input := range fs.Args() {
+		paper, err := papers.ProcessAddPaperInput(category, input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, strings.TrimSpace(err.Error()))
+			failed++
+			continue
+		}
+		fmt.Println(filepath.Join(category, paper.PaperName+".pdf"))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d papers could not be added", failed,
+			fs.NArg())
+	}
+	return nil
+}
+
+// lsCommand implements the "ls" subcommand, listing papers as tab-separated
+// key, year and title, or as the JSON of the API
+func lsCommand(args []string) error {
+	var papers Papers
+	var asJSON bool
+	q := Query{Page: 1, PerPage: math.MaxInt32}
+
+	fs := newFlagSet("ls")
+	papers.flags(fs)
+	fs.StringVar(&q.Category, "c", "",
+		"Category to list, including its subcategories")
+	fs.StringVar(&q.Sort, "sort", "category",
+		"Sort by category, title, author, year, journal or added")
+	fs.StringVar(&q.Order, "order", "asc", "Sort order, asc or desc")
+	fs.BoolVar(&asJSON, "json", false, "Print papers as JSON")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+	q.Category = strings.Trim(q.Category, "/")
+	listings, _ := papers.Query(q)
+
+	if asJSON {
+		list := []APIPaper{}
+		for _, l := range listings {
+			list = append(list, newAPIPaper(l.Key, l.Paper))
+		}
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(list)
+	}
+	for _, l := range listings {
+		fmt.Printf("%s\t%s\t%s\n", l.Key, l.Paper.Meta.PubYear,
+			getTitle(l.Paper))
+	}
+	return nil
+}
+
+// mvCommand implements the "mv" subcommand; like mv(1), papers are moved into
+// the destination category, while categories are moved into it if it exists
+// or renamed to it otherwise
+func mvCommand(args []string) error {
+	var papers Papers
+
+	fs := newFlagSet("mv")
+	papers.flags(fs)
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+	// sanitized as the add form's categories are, so papers can't be moved
+	// outside papers.Path; sources must be in the set, so need no sanitizing
+	dest := strings.Trim(strings.Replace(fs.Arg(fs.NArg()-1), "..", "", -1),
+		"/.")
+	if dest == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	for _, src := range fs.Args()[:fs.NArg()-1] {
+		src = strings.Trim(src, "/")
+		papers.RLock()
+		_, isCategory := papers.List[src]
+		_, destExists := papers.List[dest]
+		_, isPaper := papers.List[filepath.Dir(src)][src]
+
+		// the highest of dest and its parents which is yet to be created, so
+		// it can be removed again if the move fails
+		created := dest
+		for n := filepath.Dir(dest); n != "."; n = filepath.Dir(n) {
+			if _, exists := papers.List[n]; exists {
+				break
+			}
+			created = n
+		}
+		papers.RUnlock()
+
+		var err error
+		switch {
+		case isCategory && destExists:
+			err = papers.MoveCategory(src, dest)
+		case isCategory:
+			err = papers.RenameCategory(src, dest)
+		case isPaper == false:
+			err = fmt.Errorf("no such paper or category")
+		default:
+			if err = papers.NewCategory(dest); err == nil {
+				err = papers.MovePaper(src, dest)
+			}
+			if err != nil && destExists == false {
+				papers.DeleteCategory(created)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", src, strings.TrimSpace(err.Error()))
+		}
+	}
+	return nil
+}
+
+// rmCommand implements the "rm" subcommand, deleting papers and, with -r,
+// categories along with their contents
+func rmCommand(args []string) error {
+	var papers Papers
+	var recursive bool
+
+	fs := newFlagSet("rm")
+	papers.flags(fs)
+	fs.BoolVar(&recursive, "r", false,
+		"Delete categories along with their papers and subcategories")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+
+	for _, arg := range fs.Args() {
+		arg = strings.Trim(arg, "/")
+		papers.RLock()
+		_, isCategory := papers.List[arg]
+		papers.RUnlock()
+
+		var err error
+		if isCategory && !recursive {
+			err = fmt.Errorf("is a category (use -r to delete it)")
+		} else if isCategory {
+			err = papers.DeleteCategory(arg)
+		} else {
+			err = papers.DeletePaper(arg)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", arg, strings.TrimSpace(err.Error()))
+		}
+	}
+	return nil
+}
+
+// exportCommand implements the "export" subcommand, writing papers to a tar
+// archive which is gzip-compressed if its name ends in .gz
+func exportCommand(args []string) error {
+	var papers Papers
+	var category, output string
+
+	fs := newFlagSet("export")
+	papers.flags(fs)
+	fs.StringVar(&category, "c", "",
+		"Category to export, including its subcategories (default all)")
+	fs.StringVar(&output, "o", "-", "Path to write the archive to")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+
+	if output == "-" {
+		return papers.Export(os.Stdout, strings.Trim(category, "/"))
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser = f
+	if strings.HasSuffix(output, ".gz") || strings.HasSuffix(output, ".tgz") {
+		w = gzip.NewWriter(f)
+	}
+	if err := papers.Export(w, strings.Trim(category, "/")); err != nil {
+		f.Close()
+		return err
+	}
+	if w != f {
+		if err := w.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// importCommand implements the "import" subcommand, adding the papers of a
+// tar archive written by export (or read from stdin if FILE is -)
+func importCommand(args []string) error {
+	var papers Papers
+	var category string
+
+	fs := newFlagSet("import")
+	papers.flags(fs)
+	fs.StringVar(&category, "c", "",
+		"Category to import beneath (default top level)")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	category = strings.Trim(strings.Replace(category, "..", "", -1), "/.")
+	added, skipped, err := papers.Import(r, category)
+	for _, key := range added {
+		fmt.Println(key)
+	}
+	var invalid int
+	for _, s := range skipped {
+		if s.Err == nil {
+			fmt.Fprintf(os.Stderr, "%s: skipped duplicate\n", s.Key)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: skipped: %v\n", s.Key, s.Err)
+			invalid++
+		}
+	}
+	if err == nil && invalid > 0 {
+		err = fmt.Errorf("%d invalid papers skipped", invalid)
+	}
+	return err
+}
+
+// verifyCommand implements the "verify" subcommand, reporting (and with
+// -repair, fixing) problems with the files of the library; the library isn't
+// loaded first, so files which would prevent it from loading are reported too
+func verifyCommand(args []string) error {
+	var papers Papers
+	var fetch fetchFlags
+	var repair bool
+
+	fs := newFlagSet("verify")
+	papers.flags(fs)
+	fetch.flags(fs)
+	fs.BoolVar(&repair, "repair", false, "Quarantine bad files to "+
+		QUARANTINE_DIR+" and regenerate undecodable sidecars")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if err := fetch.apply(); err != nil {
+		return err
+	}
+	var err error
+	if papers.Path, err = filepath.Abs(papers.Path); err != nil {
+		return err
+	}
+	papers.List = make(map[string]map[string]*Paper)
+
+	// notices (e.g. PDFs without a recorded digest) are reported, and
+	// repaired with -repair, but don't make the library unhealthy
+	var unrepaired, notices int
+	problems := papers.Verify()
+	for _, p := range problems {
+		fmt.Printf("%s: %s: %s\n", p.Path, p.Kind, p.Reason)
+		if p.Notice() {
+			notices++
+		}
+		if !repair {
+			if !p.Notice() {
+				unrepaired++
+			}
+			continue
+		}
+		if done, err := papers.Repair(p); err != nil {
+			fmt.Printf("%s: not repaired: %v\n", p.Path, err)
+			if !p.Notice() {
+				unrepaired++
+			}
+		} else {
+			fmt.Printf("%s: %s\n", p.Path, done)
+		}
+	}
+	if unrepaired > 0 {
+		return fmt.Errorf("%d of %d problems remain", unrepaired,
+			len(problems)-notices)
+	}
+	return nil
+}
+
+// userCommand implements the "user" subcommand, managing the accounts of a
+// users file without running the server; passwords are read from stdin
+//
+//	crane user -users FILE set NAME ROLE
+//	crane user -users FILE del NAME
+//	crane user -users FILE ls
+func userCommand(args []string) error {
+	fs := newFlagSet("user")
+	fs.StringVar(&users.Path, "users", "users", "Path to users file")
+	fs.String("config", "", "Path to configuration file (optional)")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if err := users.Load(); err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "set", "add":
+		if fs.NArg() != 3 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		role, err := parseRole(fs.Arg(2))
+		if err != nil {
+			return err
+		}
+		password, err := readPassword("Password (blank to keep existing): ")
+		if err != nil {
+			return err
+		}
+		return users.SetUser(fs.Arg(1), password, role)
+	case "del", "rm":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		return users.DeleteUser(fs.Arg(1))
+	case "ls":
+		for _, u := range users.Sorted() {
+			fmt.Printf("%s\t%s\n", u.Name, u.Role)
+		}
+		return nil
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+// readPassword prompts for a password on stderr and reads it from stdin,
+// without echoing it if stdin is a terminal; otherwise, e.g. when piped, the
+// first line is read
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// cookiesCommand implements the "cookies" subcommand, importing cookies.txt
+// files exported from a browser into the outbound cookie jar, listing it, and
+// clearing the cookies of a domain
+func cookiesCommand(args []string) error {
+	var papers Papers
+	var domain string
+
+	fs := newFlagSet("cookies")
+	papers.flags(fs)
+	fs.StringVar(&domain, "d", "", "Import the cookies of this domain and "+
+		"its subdomains only")
+	if err := configure(fs, interspersed(fs, args)); err != nil {
+		return err
+	}
+	if err := papers.Open(); err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "import":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var r io.Reader = os.Stdin
+		if fs.Arg(1) != "-" {
+			f, err := os.Open(fs.Arg(1))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		n, err := jar.Import(r, domain)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fs.Arg(1), err)
+		}
+		fmt.Printf("imported %d cookies\n", n)
+		return nil
+	case "ls":
+		for _, c := range jar.List() {
+			expires := "session"
+			if !c.Expires.IsZero() {
+				expires = formatTime(c.Expires)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", c.host(), c.Path, c.Name,
+				expires)
+		}
+		return nil
+	case "clear":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		n, err := jar.Clear(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("cleared %d cookies\n", n)
+		return nil
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ENV_PREFIX prefixes the environment variable corresponding to each flag,
+// e.g. CRANE_SCI_HUB for -sci-hub
+const ENV_PREFIX = "CRANE_"
+
+// envName returns the environment variable corresponding to a flag name
+func envName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// readSecret returns the contents of the file at path less trailing newlines,
+// e.g. a password written to /run/secrets by a container runtime
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// parseConfig reads a configuration file of key = value lines, where keys are
+// flag names (e.g. sci-hub = https://sci-hub.se/), values may be quoted and
+// lines beginning with # are comments
+func parseConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v := strings.SplitN(line, "=", 2)
+		if len(v) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, value := strings.TrimSpace(v[0]), strings.TrimSpace(v[1])
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+		config[key] = value
+	}
+	return config, s.Err()
+}
+
+// configure parses the command line and sets every flag not provided on it
+// from, in order of precedence, its CRANE_* environment variable or the
+// configuration file named by -config or CRANE_CONFIG; any setting may instead
+// be read from a file with a _FILE environment variable or -file key, e.g.
+// CRANE_PASS_FILE=/run/secrets/crane or pass-file = /run/secrets/crane, which
+// keeps secrets off the command line and out of the environment
+func configure(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var path string
+	if f := fs.Lookup("config"); f != nil {
+		path = f.Value.String()
+	}
+	if set["config"] == false {
+		path = os.Getenv(envName("config"))
+	}
+	config := make(map[string]string)
+	if path != "" {
+		var err error
+		if config, err = parseConfig(path); err != nil {
+			return err
+		}
+	}
+	// subcommands share the server's configuration file but define only some
+	// of its flags, so only the server's catches misspelled settings
+	for key := range config {
+		if fs == flag.CommandLine && (key == "config" ||
+			fs.Lookup(strings.TrimSuffix(key, "-file")) == nil) {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "config" {
+			return
+		}
+		var value, from string
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			value, from = v, envName(f.Name)
+		} else if v, ok := os.LookupEnv(envName(f.Name) + "_FILE"); ok {
+			from = envName(f.Name) + "_FILE"
+			if value, err = readSecret(v); err != nil {
+				return
+			}
+		} else if v, ok := config[f.Name]; ok {
+			value, from = v, path
+		} else if v, ok := config[f.Name+"-file"]; ok {
+			from = path
+			if value, err = readSecret(v); err != nil {
+				return
+			}
+		} else {
+			return
+		}
+		if e := f.Value.Set(value); e != nil {
+			err = fmt.Errorf("%s: invalid value %q for %s: %v", from, value,
+				f.Name, e)
+		}
+	})
+	return err
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"encoding/xml"
 	"errors"
 	"flag"
@@ -12,30 +11,42 @@ import (
 	"mime"
 	"net"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"golang.org/x/net/publicsuffix"
+	"golang.org/x/net/html"
 )
 
 const (
-	TIMEOUT  time.Duration = 25       // seconds to wait for an outbound HTTP request to complete
-	MAX_SIZE int64         = 50000000 // max incoming HTTP request body size (50MB)
+	TIMEOUT  time.Duration = 25       // default seconds to wait for an outbound HTTP response's headers
+	MAX_SIZE int64         = 50000000 // default max incoming HTTP request body size (50MB)
+)
+
+// sources a paper may be downloaded from, recorded in its Provenance
+const (
+	SOURCE_SCIHUB   = "sci-hub"
+	SOURCE_CITATION = "citation_pdf_url"
+	SOURCE_DIRECT   = "direct"
+	SOURCE_RULE     = "rule"
 )
 
 var (
-	client      *http.Client
-	scihubURL   *url.URL
-	host        string
-	port        uint64
-	user        string
-	pass        string
-	buildPrefix string
+	users          Users
+	client         *http.Client
+	scihubURL      *url.URL
+	user           string
+	pass           string
+	buildPrefix    string
+	timeout        time.Duration
+	maxSize        int64
+	basePath       string       // path crane is served beneath, e.g. /library
+	trustedProxies []*net.IPNet // proxies whose X-Forwarded-* headers are honored
+	trustSocket    bool         // Unix domain socket peers' headers are honored
 )
 
 type Contributor struct {
@@ -45,6 +56,16 @@ type Contributor struct {
 	Sequence  string `xml:"sequence,attr"`
 }
 
+// Provenance records when and from where a paper was downloaded; it is stored
+// alongside the doi.org metadata in the paper's XML sidecar
+type Provenance struct {
+	Added  time.Time `xml:"added"`
+	Source string    `xml:"source"` // sci-hub, citation_pdf_url or direct
+	Input  string    `xml:"input"`  // user input, e.g. a DOI or landing page
+	URL    string    `xml:"url"`    // final PDF URL following redirects
+	SHA256 string    `xml:"sha256"`
+}
+
 type Meta struct {
 	XMLName      xml.Name      `xml:"doi_records"`
 	Journal      string        `xml:"doi_record>crossref>journal>journal_metadata>full_title"`
@@ -58,6 +79,7 @@ type Meta struct {
 	DOI          string        `xml:"doi_record>crossref>journal>journal_article>doi_data>doi"`
 	ArxivID      string        `xml:"doi_record>crossref>journal>journal_article>arxiv_data>arxiv_id"`
 	Resource     string        `xml:"doi_record>crossref>journal>journal_article>doi_data>resource"`
+	Provenance   *Provenance   `xml:"provenance,omitempty"`
 }
 
 type Paper struct {
@@ -65,16 +87,56 @@ type Paper struct {
 	MetaPath  string
 	PaperName string
 	PaperPath string
+	Added     time.Time
+	SHA256    string // hex-encoded digest of the PDF
 }
 
 type Papers struct {
 	sync.RWMutex
-	List map[string]map[string]*Paper
+	List   map[string]map[string]*Paper
+	Access map[string]*Access // categories with an ACCESS_FILE
+
+	// files which couldn't be read while populating the set
+	LoadErrors []LoadError
+	Path       string
+
+	// papers.List keys by PDF digest and lowercased DOI, for findDuplicate
+	bySum map[string]map[string]bool
+	byDOI map[string]map[string]bool
+
+	// digests of PDFs without one recorded in their sidecar
+	digests Digests
+}
+
+// Category is a node in the tree of nested categories derived from the
+// papers.List set, e.g. foo/bar is a child of foo
+type Category struct {
+	Name     string // base name of the category, e.g. bar
+	Path     string // papers.List key, e.g. foo/bar
+	Count    int    // papers in the category and its descendants
+	Open     bool   // category is, or is an ancestor of, the one being viewed
+	Children []*Category
+}
+
+// Crumb is a single level of breadcrumb navigation, e.g. bar in foo/bar/baz
+type Crumb struct {
+	Name string
 	Path string
 }
 
 type Resp struct {
-	Papers           Papers
+	Papers           *Papers
+	User             *User
+	CSRF             string
+	Listings         []Listing
+	Pages            Pages
+	Query            Query
+	Journals         []string
+	Categories       []string
+	Visible          map[string]map[string]*Paper // visible subset of Papers.List
+	Tree             []*Category
+	Crumbs           []Crumb
+	Category         string
 	Status           string
 	LastPaperDL      string
 	LastUsedCategory string
@@ -121,6 +183,66 @@ func getPaperFileNameFromResp(resp *http.Response) string {
 	return filename
 }
 
+// getCrumbs returns the breadcrumbs leading to category, the first being the
+// top-level ancestor and the last the category itself
+func getCrumbs(category string) []Crumb {
+	var crumbs []Crumb
+	for n := category; n != "." && n != ""; n = filepath.Dir(n) {
+		crumbs = append([]Crumb{{Name: filepath.Base(n), Path: n}}, crumbs...)
+	}
+	return crumbs
+}
+
+// CategoryTree returns the visible categories of the papers.List set as a tree
+// sorted by name; categories leading to current are marked open
+func (papers *Papers) CategoryTree(current string,
+	visible func(string) bool) []*Category {
+	papers.RLock()
+	counts := make(map[string]int, len(papers.List))
+	for key, set := range papers.List {
+		counts[key] = len(set)
+	}
+	papers.RUnlock()
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		if visible(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	// parents sort before their children (e.g. foo, foo/bar), so each parent
+	// node exists by the time its children are reached
+	sort.Strings(keys)
+
+	var tree []*Category
+	nodes := make(map[string]*Category)
+	for _, key := range keys {
+		node := &Category{
+			Name:  filepath.Base(key),
+			Path:  key,
+			Count: counts[key],
+			Open: current == key ||
+				strings.HasPrefix(current, key+"/"),
+		}
+		nodes[key] = node
+		if parent, exists := nodes[filepath.Dir(key)]; exists {
+			parent.Children = append(parent.Children, node)
+		} else {
+			tree = append(tree, node)
+		}
+	}
+
+	// children sort after their parents; walk backwards so descendant counts
+	// are complete before being added to the parent
+	for i := len(keys) - 1; i >= 0; i-- {
+		if parent, exists := nodes[filepath.Dir(keys[i])]; exists {
+			parent.Count += nodes[keys[i]].Count
+		}
+	}
+	return tree
+}
+
 // getUniqueName ensures a paper name is unique, appending "-$ext" until
 // a unique name is found and returned
 func (papers *Papers) getUniqueName(category string, name string) string {
@@ -144,33 +266,55 @@ func (papers *Papers) getUniqueName(category string, name string) string {
 // stored on the filesystem
 func (papers *Papers) findPapersWalk(path string, info os.FileInfo,
 	err error) error {
-	// skip the papers.Path root directory
-	if p, _ := filepath.Abs(path); p == papers.Path ||
-		strings.HasPrefix(filepath.Base(path), ".") {
-
+	// skip the papers.Path root directory and hidden files; hidden directories
+	// (e.g. QUARANTINE_DIR) are skipped along with their contents
+	if p, _ := filepath.Abs(path); p == papers.Path {
+		return err
+	}
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
 		return nil
 	}
 
-	papers.Lock()
-	defer papers.Unlock()
+	// a single unreadable file or directory shouldn't prevent the rest of the
+	// library from loading
+	if err != nil {
+		papers.Lock()
+		papers.loadError(path, err)
+		papers.Unlock()
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
 
 	// derive category name (e.g. Mathematics) from directory name; used as key
 	var category string
-	if i, _ := os.Stat(path); i.IsDir() {
+	if info.IsDir() {
 		category = strings.TrimPrefix(path, papers.Path+"/")
 	} else {
 		category = strings.TrimPrefix(filepath.Dir(path), papers.Path+"/")
 	}
-	if _, exists := papers.List[category]; exists == false {
-		papers.List[category] = make(map[string]*Paper)
-	}
 
-	// now that category was added, ensure file is actually a PDF
+	// directories and files other than PDFs only add their category
 	if filepath.Ext(path) != ".pdf" {
+		papers.Lock()
+		if _, exists := papers.List[category]; exists == false {
+			papers.List[category] = make(map[string]*Paper)
+		}
+		papers.Unlock()
 		return nil
 	}
 
+	// the files are read without the lock held, so handlers aren't blocked
+	// while a paper is hashed
 	var paper Paper
+	var metaErr error
+	if info != nil {
+		paper.Added = info.ModTime()
+	}
 	paper.PaperName = strings.TrimSuffix(filepath.Base(path),
 		filepath.Ext(path))
 	paper.PaperPath = filepath.Join(papers.Path, filepath.Join(category,
@@ -186,44 +330,92 @@ func (papers *Papers) findPapersWalk(path string, info os.FileInfo,
 	if _, err := os.Stat(metaPath); err == nil {
 		paper.MetaPath = metaPath
 
-		f, err := os.Open(paper.MetaPath)
-		if err != nil {
-			return err
+		// a sidecar which can't be read or decoded is recorded and the paper
+		// loaded without metadata; MetaPath is kept so the sidecar stays with
+		// the paper when it's moved or deleted
+		if metaErr = decodeMeta(metaPath, &paper.Meta); metaErr != nil {
+			paper.Meta = Meta{}
 		}
 
-		// memory-efficient relative to ioutil.ReadAll()
-		r := bufio.NewReader(f)
-		d := xml.NewDecoder(r)
-
-		// populate p struct with values derived from doi.org metadata
-		if err := d.Decode(&paper.Meta); err != nil {
-			return err
-		}
-		if err := f.Close(); err != nil {
-			return err
+		// prefer the recorded download time over the file's modification
+		// time, which changes when the file is copied
+		if paper.Meta.Provenance != nil &&
+			!paper.Meta.Provenance.Added.IsZero() {
+			paper.Added = paper.Meta.Provenance.Added
 		}
 	}
 
+	// digests are recorded at download; papers added by other means are
+	// hashed so duplicates of them can be detected, the digest being cached
+	// in DIGESTS_FILE until Repair records it
+	relPath := filepath.Join(category, paper.PaperName+".pdf")
+	if paper.Meta.Provenance != nil && paper.Meta.Provenance.SHA256 != "" {
+		paper.SHA256 = paper.Meta.Provenance.SHA256
+	} else if sum, err := papers.digests.hash(relPath, paper.PaperPath,
+		info); err == nil {
+		paper.SHA256 = sum
+	}
+
+	papers.Lock()
+	defer papers.Unlock()
+	if metaErr != nil {
+		papers.loadError(metaPath, metaErr)
+	}
+	if _, exists := papers.List[category]; exists == false {
+		papers.List[category] = make(map[string]*Paper)
+	}
+
 	// finally add paper to papers.List set; the subkey is the paper path
 	// relative to papers.Path, e.g. Mathematics/example2020.pdf
-	relPath := filepath.Join(category, paper.PaperName+".pdf")
+	if prev, exists := papers.List[category][relPath]; exists {
+		papers.unindex(relPath, prev)
+	}
 	papers.List[category][relPath] = &paper
+	papers.index(relPath, &paper)
 	return nil
 }
 
+// decodeMeta decodes the XML sidecar at path into meta
+func decodeMeta(path string, meta *Meta) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// memory-efficient relative to ioutil.ReadAll()
+	r := bufio.NewReader(f)
+	d := xml.NewDecoder(r)
+
+	// populate p struct with values derived from doi.org metadata
+	return d.Decode(meta)
+}
+
 // PopulatePapers wraps filepath.Walk() and populates the papers set with
-// discovered papers
+// discovered papers; files which can't be read are recorded in
+// papers.LoadErrors rather than aborting the walk
 func (papers *Papers) PopulatePapers() error {
+	papers.Lock()
+	papers.LoadErrors = nil
+	papers.Unlock()
+
+	papers.digests.load(papers.Path)
 	if err := filepath.Walk(papers.Path, papers.findPapersWalk); err != nil {
 		return err
 	}
-	return nil
+	papers.Lock()
+	defer papers.Unlock()
+	papers.digests.retain(papers.List)
+	if err := papers.digests.save(papers.Path); err != nil {
+		log.Printf("saving %s: %v", DIGESTS_FILE, err)
+	}
+	return papers.loadAccess()
 }
 
 // NewPaperFromDOI contains routines used to retrieve papers from remote
-// endpoints provided a DOI
-func (papers *Papers) NewPaperFromDOI(doi []byte, category string) (*Paper,
-	error) {
+// endpoints provided a DOI; input is the user input which led to the DOI
+func (papers *Papers) NewPaperFromDOI(doi []byte, category string,
+	input string) (*Paper, error) {
 	var paper Paper
 
 	meta, err := getMetaFromDOI(client, doi)
@@ -231,20 +423,6 @@ func (papers *Papers) NewPaperFromDOI(doi []byte, category string) (*Paper,
 		return nil, err
 	}
 
-	// create a temporary file to store XML stream
-	tmpXML, err := ioutil.TempFile("", "tmp-*.meta.xml")
-	if err != nil {
-		return nil, err
-	}
-	defer os.Remove(tmpXML.Name())
-
-	e := xml.NewEncoder(tmpXML)
-	err = e.Encode(meta)
-	if err != nil {
-		return nil, err
-	}
-	tmpXML.Close()
-
 	name := getPaperFileNameFromMeta(meta) // doe2020
 
 	// last-resort if metadata lacking author or publication year
@@ -253,20 +431,14 @@ func (papers *Papers) NewPaperFromDOI(doi []byte, category string) (*Paper,
 		name = strings.Replace(string(doi), "/", "", -1)
 	}
 
+	// refuse papers whose DOI is already present in any category
+	if key := papers.findDuplicate("", meta.DOI); key != "" {
+		return nil, &DuplicateError{key, string(doi)}
+	}
+
 	// doe2020-(2, 3, 4...) if n already exists in set
 	uniqueName := papers.getUniqueName(category, name)
 
-	// check if DOIs match (genuine duplicate)
-	if name != uniqueName {
-		key := filepath.Join(category, name+".pdf")
-		papers.RLock()
-		if meta.DOI == papers.List[category][key].Meta.DOI {
-			return nil, fmt.Errorf("paper %q with DOI %q already downloaded",
-				name, string(doi))
-		}
-		papers.RUnlock()
-	}
-
 	paper.PaperName = uniqueName
 	paper.PaperPath = filepath.Join(filepath.Join(papers.Path, category),
 		paper.PaperName+".pdf")
@@ -274,51 +446,65 @@ func (papers *Papers) NewPaperFromDOI(doi []byte, category string) (*Paper,
 		paper.PaperName+".meta.xml")
 
 	// make outbound request to sci-hub, save paper to temporary location
-	tmpPDF, err := getPaper(client, scihubURL, string(doi))
-	defer os.Remove(tmpPDF)
+	tmpPDF, prov, err := getPaper(client, scihubURL, string(doi), category)
+	defer func() { os.Remove(tmpPDF) }()
 	if err != nil {
 		// try passing resource URL (from doi.org metadata) to sci-hub instead
 		// (force cache)
 		if meta.Resource != "" {
-			if tmpPDF, err = getPaper(client, scihubURL, meta.Resource); err != nil {
+			if tmpPDF, prov, err = getPaper(client, scihubURL,
+				meta.Resource, category); err != nil {
 				return nil, err
 			}
 		} else {
 			return nil, err
 		}
 	}
+	prov.Input = input
+	meta.Provenance = prov
 
-	if err := renameFile(tmpPDF, paper.PaperPath); err != nil {
-		return nil, err
+	if key := papers.findDuplicate(prov.SHA256, ""); key != "" {
+		return nil, &DuplicateError{Key: key}
 	}
-	if err := renameFile(tmpXML.Name(), paper.MetaPath); err != nil {
+
+	paper.Meta = *meta
+	paper.Added = prov.Added
+	paper.SHA256 = prov.SHA256
+	if err := papers.storePaper(category, &paper, tmpPDF); err != nil {
 		return nil, err
 	}
-	paper.Meta = *meta
-
-	papers.Lock()
-	papers.List[category][filepath.Join(category,
-		paper.PaperName+".pdf")] = &paper
-	papers.Unlock()
 	return &paper, nil
 }
 
 // NewPaperFromDirectLink contains routines used to retrieve papers from remote
-// endpoints provided a direct link's http.Response and/or optional metadata
+// endpoints provided a direct link's http.Response and/or optional metadata;
+// input is the user input which led to the link
 func (papers *Papers) NewPaperFromDirectLink(resp *http.Response, meta *Meta,
-	category string) (*Paper, error) {
+	source string, category string, input string) (*Paper, error) {
 	tmpPDF, err := ioutil.TempFile("", "tmp-*.pdf")
 	if err != nil {
 		return &Paper{}, err
 	}
-	err = saveRespBody(resp, tmpPDF.Name())
+	tmpPDF.Close()
+	defer os.Remove(tmpPDF.Name())
+
+	// the link was either provided directly or discovered in the page
+	// provided, by its citation <meta> tags or the extraction rules
+	sum, err := saveRespBody(resp, tmpPDF.Name(), source, category)
 	if err != nil {
 		return &Paper{}, err
 	}
-	if err := tmpPDF.Close(); err != nil {
-		return &Paper{}, err
+	meta.Provenance = &Provenance{
+		Added:  time.Now(),
+		Source: source,
+		Input:  input,
+		URL:    resp.Request.URL.String(),
+		SHA256: sum,
+	}
+
+	if key := papers.findDuplicate(sum, meta.DOI); key != "" {
+		return nil, &DuplicateError{Key: key}
 	}
-	defer os.Remove(tmpPDF.Name())
 
 	var paper Paper
 	paper.PaperName = papers.getUniqueName(category,
@@ -329,27 +515,59 @@ func (papers *Papers) NewPaperFromDirectLink(resp *http.Response, meta *Meta,
 	}
 	paper.PaperPath = filepath.Join(papers.Path,
 		filepath.Join(category, paper.PaperName+".pdf"))
+	paper.MetaPath = filepath.Join(papers.Path,
+		filepath.Join(category, paper.PaperName+".meta.xml"))
 
-	if err := renameFile(tmpPDF.Name(), paper.PaperPath); err != nil {
+	paper.Meta = *meta
+	paper.Added = meta.Provenance.Added
+	paper.SHA256 = sum
+	if err := papers.storePaper(category, &paper,
+		tmpPDF.Name()); err != nil {
 		return nil, err
 	}
-	papers.Lock()
-	papers.List[category][filepath.Join(category,
-		paper.PaperName+".pdf")] = &paper
-	papers.Unlock()
 	return &paper, nil
 }
 
+// storePaper moves the downloaded PDF at tmpPDF to paper.PaperPath, writes
+// its metadata to paper.MetaPath and adds it to the papers.List set; the lock
+// is held throughout, so the category can't be moved, renamed or deleted
+// while the files are written
+func (papers *Papers) storePaper(category string, paper *Paper,
+	tmpPDF string) error {
+	papers.Lock()
+	defer papers.Unlock()
+
+	// the category may have gone while the paper was downloaded
+	if _, exists := papers.List[category]; exists == false {
+		return fmt.Errorf("category %q no longer exists", category)
+	}
+	if err := renameFile(tmpPDF, paper.PaperPath); err != nil {
+		return err
+	}
+	if err := writeMeta(&paper.Meta, paper.MetaPath); err != nil {
+		return err
+	}
+	key := filepath.Join(category, paper.PaperName+".pdf")
+	papers.List[category][key] = paper
+	papers.index(key, paper)
+	return nil
+}
+
 // DeletePaper deletes a paper and its metadata from the filesystem and the
 // papers.List set
 func (papers *Papers) DeletePaper(paper string) error {
+	papers.Lock()
+	defer papers.Unlock()
+	return papers.deletePaper(paper)
+}
+
+// deletePaper deletes a paper, as DeletePaper does; callers hold the lock
+func (papers *Papers) deletePaper(paper string) error {
 	// check if the category in which the paper is said to belong
 	// exists
-	papers.RLock()
 	category := filepath.Dir(paper)
 	if _, exists := papers.List[category]; exists != true {
-		return fmt.Errorf("category %q does not exist\n",
-			papers.List[filepath.Dir(paper)])
+		return fmt.Errorf("category %q does not exist\n", category)
 	}
 
 	// check if paper already exists in the provided category
@@ -357,11 +575,9 @@ func (papers *Papers) DeletePaper(paper string) error {
 		return fmt.Errorf("paper %q does not exist in category %q\n", paper,
 			category)
 	}
-	papers.RUnlock()
 
 	// paper and category exists and the paper belongs to the provided
 	// category; remove it and its XML metadata
-	papers.Lock()
 	if err := os.Remove(papers.List[category][paper].PaperPath); err != nil {
 		return err
 	}
@@ -375,41 +591,61 @@ func (papers *Papers) DeletePaper(paper string) error {
 			}
 		}
 	}
+	papers.unindex(paper, papers.List[category][paper])
 	delete(papers.List[category], paper)
-	papers.Unlock()
+	return nil
+}
+
+// NewCategory creates a category, and any missing parents, on the filesystem
+// and the papers.List set; existing categories are left as they are
+func (papers *Papers) NewCategory(category string) error {
+	papers.Lock()
+	defer papers.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(papers.Path, category),
+		os.ModePerm); err != nil {
+		return err
+	}
+	for n := category; n != "."; n = filepath.Dir(n) {
+		if _, exists := papers.List[n]; exists == false {
+			papers.List[n] = make(map[string]*Paper)
+		}
+	}
 	return nil
 }
 
 // DeleteCategory deletes a category and its contents from the filesystem and
 // the papers.List set
 func (papers *Papers) DeleteCategory(category string) error {
-	papers.RLock()
+	papers.Lock()
+	defer papers.Unlock()
+
 	if _, exists := papers.List[category]; exists != true {
 		return fmt.Errorf("category %q does not exist in the set\n", category)
 	}
-	papers.RUnlock()
-
-	papers.Lock()
 	if err := os.RemoveAll(filepath.Join(papers.Path, category)); err != nil {
 		return err
 	}
 
 	// remove subcategories (nested directories) which exist under the primary
-	for key, _ := range papers.List {
-		if strings.HasPrefix(key, category+"/") {
+	for key, set := range papers.List {
+		if key == category || strings.HasPrefix(key, category+"/") {
+			for k, paper := range set {
+				papers.unindex(k, paper)
+			}
 			delete(papers.List, key)
+			delete(papers.Access, key)
 		}
 	}
-
-	delete(papers.List, category)
-	papers.Unlock()
 	return nil
 }
 
 // MovePaper moves a paper to the destination category on the filesystem and
 // the papers.List set
 func (papers *Papers) MovePaper(paper string, category string) error {
-	papers.RLock()
+	papers.Lock()
+	defer papers.Unlock()
+
 	prevCategory := filepath.Dir(paper)
 	if _, exists := papers.List[prevCategory]; exists != true {
 		return fmt.Errorf("category %q does not exist\n", prevCategory)
@@ -421,13 +657,12 @@ func (papers *Papers) MovePaper(paper string, category string) error {
 		return fmt.Errorf("paper %q does not exist in category %q\n", paper,
 			prevCategory)
 	}
-	if _, exists := papers.List[category][paper]; exists == true {
+	if _, exists := papers.List[category][filepath.Join(category,
+		filepath.Base(paper))]; exists == true {
 		return fmt.Errorf("paper %q exists in destination category %q\n",
 			paper, category)
 	}
-	papers.RUnlock()
 
-	papers.Lock()
 	paperDest := filepath.Join(filepath.Join(papers.Path, category),
 		papers.List[prevCategory][paper].PaperName+".pdf")
 	if err := os.Rename(papers.List[prevCategory][paper].PaperPath, paperDest); err != nil {
@@ -436,6 +671,9 @@ func (papers *Papers) MovePaper(paper string, category string) error {
 
 	papers.List[category][filepath.Join(category,
 		filepath.Base(paper))] = papers.List[prevCategory][paper]
+	papers.unindex(paper, papers.List[prevCategory][paper])
+	papers.index(filepath.Join(category, filepath.Base(paper)),
+		papers.List[prevCategory][paper])
 
 	papers.List[category][filepath.Join(category,
 		filepath.Base(paper))].PaperPath = paperDest
@@ -456,116 +694,233 @@ func (papers *Papers) MovePaper(paper string, category string) error {
 		}
 	}
 	delete(papers.List[prevCategory], paper)
-
-	papers.Unlock()
 	return nil
 }
 
 // RenameCategory renames a category on the filesystem and the paper.List set
 func (papers *Papers) RenameCategory(oldCategory string,
 	newCategory string) error {
-	papers.RLock()
+	papers.Lock()
+	defer papers.Unlock()
+	return papers.relocateCategory(oldCategory, newCategory)
+}
+
+// MoveCategory moves a category (and its subcategories) beneath the parent
+// category on the filesystem and the papers.List set; an empty parent moves
+// the category to the top level, e.g. ML -> CS/ML
+func (papers *Papers) MoveCategory(category string, parent string) error {
+	// the parent is checked under the same lock as the move, so it can't be
+	// renamed or deleted in between
+	papers.Lock()
+	defer papers.Unlock()
+	if _, exists := papers.List[parent]; parent != "" && exists != true {
+		return fmt.Errorf("category %q does not exist in the set\n", parent)
+	}
+	return papers.relocateCategory(category,
+		filepath.Join(parent, filepath.Base(category)))
+}
+
+// relocateCategory moves the directory of oldCategory to newCategory and
+// rekeys it, every nested subcategory and their papers in the papers.List
+// set; missing parents of newCategory are created. Callers hold the lock
+func (papers *Papers) relocateCategory(oldCategory string,
+	newCategory string) error {
 	if _, exists := papers.List[oldCategory]; exists != true {
 		return fmt.Errorf("category %q does not exist in the set\n", oldCategory)
 	}
 	if _, exists := papers.List[newCategory]; exists == true {
 		return fmt.Errorf("category %q already exists in the set\n", newCategory)
 	}
+	if strings.HasPrefix(newCategory, oldCategory+"/") {
+		return fmt.Errorf("category %q cannot be moved beneath itself\n",
+			oldCategory)
+	}
+
+	// accounts for nested destinations; e.g. "foo/bar/baz" where "foo/bar"
+	// and/or "foo" do not already exist
+	parent := filepath.Dir(newCategory)
+
+	// the highest of them which is yet to be created, so it can be removed
+	// again if the move fails, rather than being loaded as an empty category
+	var created string
+	for n := parent; n != "."; n = filepath.Dir(n) {
+		if _, err := os.Stat(filepath.Join(papers.Path, n)); err == nil {
+			break
+		}
+		created = n
+	}
+	if err := os.MkdirAll(filepath.Join(papers.Path, parent),
+		os.ModePerm); err != nil {
+		return err
+	}
 	if err := os.Rename(filepath.Join(papers.Path, oldCategory),
 		filepath.Join(papers.Path, newCategory)); err != nil {
+		if created != "" {
+			os.RemoveAll(filepath.Join(papers.Path, created))
+		}
 		return err
 	}
-	papers.RUnlock()
-
-	papers.Lock()
-	papers.List[newCategory] = make(map[string]*Paper)
-	for k, v := range papers.List[oldCategory] {
-		pPaperPath := filepath.Join(papers.Path, filepath.Join(newCategory,
-			v.PaperName+".pdf"))
-		pK := filepath.Join(newCategory, filepath.Base(k))
-		papers.List[newCategory][pK] = papers.List[oldCategory][k]
-		papers.List[newCategory][pK].PaperPath = pPaperPath
+	for n := parent; n != "."; n = filepath.Dir(n) {
+		if _, exists := papers.List[n]; exists == false {
+			papers.List[n] = make(map[string]*Paper)
+		}
+	}
 
-		if v.MetaPath != "" {
-			pMetaPath := filepath.Join(papers.Path, filepath.Join(newCategory,
-				v.PaperName+".meta.xml"))
-			papers.List[newCategory][pK].MetaPath = pMetaPath
+	// rekey the category and subcategories (nested directories) which exist
+	// under it, e.g. ML/NLP -> CS/ML/NLP
+	var categories []string
+	for category := range papers.List {
+		if category == oldCategory ||
+			strings.HasPrefix(category, oldCategory+"/") {
+			categories = append(categories, category)
 		}
 	}
-	delete(papers.List, oldCategory)
+	for _, category := range categories {
+		pCategory := newCategory + strings.TrimPrefix(category, oldCategory)
+		papers.List[pCategory] = make(map[string]*Paper)
+		for k, v := range papers.List[category] {
+			v.PaperPath = filepath.Join(papers.Path, filepath.Join(pCategory,
+				v.PaperName+".pdf"))
+			if v.MetaPath != "" {
+				v.MetaPath = filepath.Join(papers.Path, filepath.Join(pCategory,
+					v.PaperName+".meta.xml"))
+			}
+			papers.List[pCategory][filepath.Join(pCategory,
+				filepath.Base(k))] = v
+			papers.unindex(k, v)
+			papers.index(filepath.Join(pCategory, filepath.Base(k)), v)
+		}
+		delete(papers.List, category)
 
-	papers.Unlock()
+		// visibility files moved with the directories
+		if access, exists := papers.Access[category]; exists {
+			papers.Access[pCategory] = access
+			delete(papers.Access, category)
+		}
+	}
 	return nil
 }
 
+// newPaperFromRule downloads the paper at link, found by the extraction rules
+// in the page provided, if it is a PDF
+func (papers *Papers) newPaperFromRule(link string, meta *Meta,
+	category string, input string) (*Paper, error) {
+	resp, err := makeRequest(client, RESOLVER_PUBLISHER, link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/pdf") {
+		return nil, fmt.Errorf("%q: content-type not application/pdf", link)
+	}
+	return papers.NewPaperFromDirectLink(resp, meta, SOURCE_RULE, category,
+		input)
+}
+
+// InputError is returned when a paper can't be added because of the input
+// given, e.g. an invalid DOI, rather than a failure of the remote endpoints
+type InputError struct {
+	Err error
+}
+
+func (e *InputError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// inputError returns err as an InputError if the input which led to it is at
+// fault: its host doesn't exist or may not be connected to
+func inputError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.Is(err, errBlocked) ||
+		(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return &InputError{err}
+	}
+	return err
+}
+
 // ProcessAddPaperInput processes takes user input and attempts to retrieve
-// a DOI and initiate paper download
+// a DOI and initiate paper download; errors caused by the input itself are
+// returned as an InputError
 func (papers *Papers) ProcessAddPaperInput(category string,
 	input string) (*Paper, error) {
 	if strings.HasPrefix(input, "http") {
-		resp, err := makeRequest(client, input)
+		if u, err := url.Parse(input); err != nil || u.Host == "" {
+			return &Paper{}, &InputError{fmt.Errorf("%q is not a valid "+
+				"DOI or URL", input)}
+		}
+		resp, err := makeRequest(client, RESOLVER_PUBLISHER, input)
 		if err != nil {
-			return &Paper{}, err
+			return &Paper{}, inputError(err)
 		}
+		defer resp.Body.Close()
 		if resp.Header.Get("Content-Type") == "application/pdf" {
-			paper, err := papers.NewPaperFromDirectLink(resp, &Meta{}, category)
+			paper, err := papers.NewPaperFromDirectLink(resp, &Meta{},
+				SOURCE_DIRECT, category, input)
 			if err != nil {
 				return &Paper{}, err
 			}
 			return paper, nil
 		}
 
-		meta, err := getMetaFromCitation(resp)
+		// the landing page is closed before its links are followed, as it
+		// holds one of the requests to the host permitted at a time
+		doc, err := html.Parse(resp.Body)
+		resp.Body.Close()
 		if err != nil {
 			return nil, err
 		}
+		meta := getMetaFromPage(doc)
 		if meta.Resource != "" {
-			resp, err := makeRequest(client, meta.Resource)
+			// fetched through the institution's EZproxy, if configured
+			link := ezproxied(meta.Resource)
+			resp, err := makeRequest(client, RESOLVER_PUBLISHER, link)
+			if err == nil {
+				defer resp.Body.Close()
+			}
 			if err == nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/pdf") {
-				paper, err := papers.NewPaperFromDirectLink(resp, meta, category)
+				paper, err := papers.NewPaperFromDirectLink(resp, meta,
+					SOURCE_CITATION, category, input)
 				if err != nil {
 					return nil, err
-				} else {
-					tmpXML, err := ioutil.TempFile("", "tmp-*.meta.xml")
-					if err != nil {
-						return nil, err
-					}
-					defer os.Remove(tmpXML.Name())
-
-					e := xml.NewEncoder(tmpXML)
-					err = e.Encode(meta)
-					if err != nil {
-						return nil, err
-					}
-					tmpXML.Close()
-
-					paper.MetaPath = filepath.Join(filepath.Join(papers.Path,
-						category), paper.PaperName+".meta.xml")
-					if err := renameFile(tmpXML.Name(), paper.MetaPath); err != nil {
-						return nil, err
-					}
-
-					paper.Meta = *meta
+				}
+				return paper, nil
+			}
+		} else {
+			// pages lacking citation_pdf_url may link to their PDF in ways
+			// known to the extraction rules; links found by heuristics may
+			// be wrong, so each is tried in turn
+			for _, link := range findPDFLinks(doc, resp.Request.URL) {
+				paper, err := papers.newPaperFromRule(ezproxied(link), meta,
+					category, input)
+				if err == nil {
 					return paper, nil
 				}
+				log.Printf("%q: %v", input, err)
 			}
 		}
 		if meta.DOI != "" {
-			paper, err := papers.NewPaperFromDOI([]byte(meta.DOI), category)
+			paper, err := papers.NewPaperFromDOI([]byte(meta.DOI), category,
+				input)
 			if err != nil {
 				return nil, err
 			}
 			return paper, nil
 		} else {
-			return &Paper{}, fmt.Errorf("%q: DOI could not be discovered", input)
+			return &Paper{}, &InputError{fmt.Errorf("%q: DOI could not be "+
+				"discovered", input)}
 		}
 	} else {
 		doi := getDOIFromBytes([]byte(input))
 		if doi == nil {
-			return &Paper{}, fmt.Errorf("%q is not a valid DOI or URL\n", input)
+			return &Paper{}, &InputError{fmt.Errorf("%q is not a valid DOI "+
+				"or URL\n", input)}
 		}
-		if paper, err := papers.NewPaperFromDOI(doi, category); err != nil {
-			return nil, fmt.Errorf("%q: %v", input, err)
+		if paper, err := papers.NewPaperFromDOI(doi, category, input); err != nil {
+			return nil, fmt.Errorf("%q: %w", input, err)
 		} else {
 			return paper, nil
 		}
@@ -573,76 +928,127 @@ func (papers *Papers) ProcessAddPaperInput(category string,
 }
 
 func main() {
-	// some publishers have cookie + HTTP 302 checks (e.g. sagepub), let's look
-	// like a real browser
-	options := cookiejar.Options{
-		PublicSuffixList: publicsuffix.List,
+	newClient()
+
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	cookies, err := cookiejar.New(&options)
-	if err != nil {
-		panic(err)
-	}
-
-	// custom DialContext which blocks outbound requests to local addresses and
-	// interfaces (security)
-	http.DefaultTransport.(*http.Transport).DialContext = func(ctx context.Context,
-		network, addr string) (net.Conn, error) {
-		// we could run our check after a dial, but we'd have to discard
-		// connect errors to prevent exposure of local services; a preemptive
-		// lookup is the lesser of two evils, I think
-		hosts, _ := net.LookupHost(addr[:strings.LastIndex(addr, ":")])
-		for _, host := range hosts {
-			if isPrivateIP(net.ParseIP(host)) {
-				return nil, errors.New("requests to private IPs are blocked")
-			}
-		}
-		conn, err := net.Dial(network, addr)
-		if err != nil {
-			return nil, err
-		}
-		return conn, err
+	command, exists := commands[name]
+	if exists == false {
+		usage()
+		os.Exit(2)
 	}
-	client = &http.Client{
-		Jar:     cookies,
-		Timeout: TIMEOUT * time.Second,
+	if err := command.Run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+}
 
-	var papers Papers
-	papers.List = make(map[string]map[string]*Paper)
+// newClient sets up the client used for outbound requests, which refuses to
+// connect to private addresses
+func newClient() {
 
-	var scihub string
+	// some publishers have cookie + HTTP 302 checks (e.g. sagepub), let's look
+	// like a real browser
+	jar = NewJar()
+
+	// outbound requests to local addresses and interfaces are blocked
+	// (security), whether made directly or through a proxy
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.Proxy = proxyFor
+	transport.DialContext = dialContext
+	outbound = NewOutbound(http.DefaultTransport)
+	client = &http.Client{
+		Jar:       jar,
+		Transport: outbound,
+	}
+}
 
-	flag.StringVar(&scihub, "sci-hub", "https://sci-hub.hkvisa.net/", "Sci-Hub URL")
-	flag.StringVar(&papers.Path, "path", "./papers",
-		"Absolute or relative path to papers folder")
-	flag.StringVar(&host, "host", "127.0.0.1", "IP address to listen on")
-	flag.Uint64Var(&port, "port", 9090, "Port to listen on")
+// serveCommand implements the "serve" subcommand, the default, running the
+// web interface
+func serveCommand(args []string) error {
+	var papers Papers
+	var fetch fetchFlags
+	var listener Listener
+	var base, trustedList string
+
+	papers.flags(flag.CommandLine)
+	fetch.flags(flag.CommandLine)
+	flag.StringVar(&listener.Host, "host", "127.0.0.1", "IP address to listen on")
+	flag.Uint64Var(&listener.Port, "port", 9090, "Port to listen on")
+	flag.StringVar(&listener.Socket, "socket", "",
+		"Path of Unix domain socket to listen on instead of host/port (optional)")
+	flag.StringVar(&listener.SocketMode, "socket-mode", "0660",
+		"Permissions of the Unix domain socket, whose peers are trusted "+
+			"as proxies only with -trusted-proxies unix")
+	flag.StringVar(&listener.TLSCert, "tls-cert", "",
+		"Path to TLS certificate, reloaded when modified (optional)")
+	flag.StringVar(&listener.TLSKey, "tls-key", "",
+		"Path to TLS private key, reloaded when modified (optional)")
+	flag.Uint64Var(&listener.RedirectPort, "redirect-port", 0,
+		"Port on which to redirect plain HTTP requests to HTTPS (optional)")
+	flag.StringVar(&base, "base-path", "",
+		"Path crane is served beneath, e.g. /library (optional)")
+	flag.StringVar(&trustedList, "trusted-proxies", "",
+		"Comma-separated IPs/CIDR ranges of reverse proxies whose "+
+			"X-Forwarded-* headers are honored, and \"unix\" for peers of "+
+			"-socket (optional)")
 	flag.StringVar(&user, "user", "", "Username for /admin/ endpoints (optional)")
 	flag.StringVar(&pass, "pass", "", "Password for /admin/ endpoints (optional)")
-	flag.Parse()
-
-	papers.Path, _ = filepath.Abs(papers.Path)
-
-	scihubURL, err = url.Parse(scihub)
-	if err != nil {
-		panic(err)
+	flag.StringVar(&users.Path, "users", "",
+		"Path to users file for /admin/ endpoints (optional)")
+	flag.StringVar(&tokens.Path, "tokens", "",
+		"Path to API tokens file (optional)")
+	if err := configure(flag.CommandLine, args); err != nil {
+		return err
 	}
-	if _, err := os.Stat(papers.Path); os.IsNotExist(err) {
-		os.Mkdir(papers.Path, os.ModePerm)
+	if err := fetch.apply(); err != nil {
+		return err
+	}
+	var err error
+	if basePath, err = parseBasePath(base); err != nil {
+		return err
 	}
-	if err := papers.PopulatePapers(); err != nil {
-		panic(err)
+	if trustedProxies, trustSocket, err = parseTrustedProxies(
+		trustedList); err != nil {
+		return err
 	}
-	if net.ParseIP(host) == nil {
-		panic(errors.New("Host flag could not be parsed; is it an IP address?"))
+	if err := papers.Open(); err != nil {
+		return err
+	}
+	users.List = make(map[string]*User)
+	if users.Path != "" {
+		if err := users.Load(); err != nil {
+			return err
+		}
+	}
+	if tokens.Path != "" {
+		if err := tokens.Load(); err != nil {
+			return err
+		}
 	}
+	loadTemplates()
 
 	http.HandleFunc("/", papers.IndexHandler)
 	http.HandleFunc("/admin/", papers.AdminHandler)
 	http.HandleFunc("/admin/edit/", papers.EditHandler)
 	http.HandleFunc("/admin/add/", papers.AddHandler)
+	http.HandleFunc("/admin/duplicates/", papers.DuplicatesHandler)
+	http.HandleFunc("/admin/verify/", papers.VerifyHandler)
+	http.HandleFunc("/admin/diagnostics/", papers.DiagnosticsHandler)
+	http.HandleFunc("/admin/downloads/", papers.DownloadsHandler)
+	http.HandleFunc("/admin/cookies/", CookiesHandler)
+	http.HandleFunc("/admin/users/", UsersHandler)
+	http.HandleFunc("/admin/tokens/", papers.TokensHandler)
+	http.HandleFunc("/api/papers", papers.APIPapersHandler)
+	http.HandleFunc("/api/add", papers.APIAddHandler)
+	http.HandleFunc("/api/diagnostics", papers.APIDiagnosticsHandler)
+	http.HandleFunc("/api/downloads", papers.APIDownloadsHandler)
+	http.HandleFunc("/login", LoginHandler)
+	http.HandleFunc("/logout", LogoutHandler)
+	http.HandleFunc("/c/", papers.CategoryHandler)
+	http.HandleFunc("/p/", papers.PaperHandler)
 	http.HandleFunc("/download/", papers.DownloadHandler)
-	fmt.Printf("Listening on %v port %v (http://%v:%v/)\n", host, port, host,
-		port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil))
+	return listener.Serve(forwarded(mount(http.DefaultServeMux)))
 }
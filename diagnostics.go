@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LoadError is a file which couldn't be read, or was read only in part, while
+// populating the papers.List set, e.g. an undecodable XML sidecar
+type LoadError struct {
+	Path  string    `json:"path"` // relative to papers.Path
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// loadError logs and records a problem with the file at path; callers hold the
+// lock
+func (papers *Papers) loadError(path string, err error) {
+	rel, rerr := filepath.Rel(papers.Path, path)
+	if rerr != nil {
+		rel = path
+	}
+	log.Printf("loading %s: %v", rel, err)
+	papers.LoadErrors = append(papers.LoadErrors, LoadError{
+		Path:  rel,
+		Error: strings.TrimSpace(err.Error()),
+		Time:  time.Now(),
+	})
+}
+
+// clearLoadErrors forgets the load errors recorded for the file at path,
+// relative to papers.Path, e.g. once Repair has fixed it
+func (papers *Papers) clearLoadErrors(path string) {
+	papers.Lock()
+	defer papers.Unlock()
+
+	var kept []LoadError
+	for _, e := range papers.LoadErrors {
+		if e.Path != path {
+			kept = append(kept, e)
+		}
+	}
+	papers.LoadErrors = kept
+}
+
+// Diagnostics describes the state of the library as loaded
+type Diagnostics struct {
+	Path       string      `json:"path"`
+	Categories int         `json:"categories"`
+	Papers     int         `json:"papers"`
+	LoadErrors []LoadError `json:"load_errors"`
+}
+
+// Diagnostics returns the size of the papers.List set and the load errors
+// recorded while populating it
+func (papers *Papers) Diagnostics() Diagnostics {
+	papers.RLock()
+	defer papers.RUnlock()
+
+	d := Diagnostics{
+		Path:       papers.Path,
+		Categories: len(papers.List),
+		LoadErrors: append([]LoadError{}, papers.LoadErrors...),
+	}
+	for _, set := range papers.List {
+		d.Papers += len(set)
+	}
+	return d
+}
+
+// DiagnosticsHandler renders the load errors of the library
+func (papers *Papers) DiagnosticsHandler(w http.ResponseWriter,
+	r *http.Request) {
+
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
+	}
+	if session.Token != nil && len(session.Token.Categories) > 0 {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+	d := papers.Diagnostics()
+	diagnosticsTemp.Execute(w, &d)
+}
+
+// APIDiagnosticsHandler returns the load errors of the library as JSON
+func (papers *Papers) APIDiagnosticsHandler(w http.ResponseWriter,
+	r *http.Request) {
+
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
+	}
+	if session.Token != nil && len(session.Token.Categories) > 0 {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, papers.Diagnostics())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// resolvers an outbound request may be made for, each of which may be routed
+// through its own proxy
+const (
+	RESOLVER_DOI       = "doi"       // doi.org metadata
+	RESOLVER_SCIHUB    = "sci-hub"   // Sci-Hub pages and PDFs
+	RESOLVER_PUBLISHER = "publisher" // landing pages and direct links
+)
+
+// PROXY_DIRECT is the proxy setting of a resolver whose requests bypass the
+// default proxy
+const PROXY_DIRECT = "direct"
+
+var (
+	allowedIPs []*net.IPNet // exempt from the private address check
+	blockedIPs []*net.IPNet // blocked in addition to private addresses
+
+	proxies    = make(map[string]*url.URL) // by resolver; "" is the default
+	proxyAddrs = make(map[string]bool)     // of proxies in use, e.g. 127.0.0.1:9050
+	proxyMu    sync.Mutex
+)
+
+type resolverKey struct{}
+
+// withResolver returns req marked as made for the named resolver
+func withResolver(req *http.Request, resolver string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), resolverKey{},
+		resolver))
+}
+
+// parseProxy parses the URL of an HTTP (CONNECT) or SOCKS5 proxy, e.g.
+// socks5h://127.0.0.1:9050 for Tor; PROXY_DIRECT, or an empty string, is nil
+func parseProxy(s string) (*url.URL, error) {
+	if s == "" || s == PROXY_DIRECT {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %q must be an http, https, socks5 or "+
+			"socks5h URL", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// proxyAddr returns the host:port dialed to reach the proxy
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		if port == "" {
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// proxyFor is the Proxy func of the outbound transport: it returns the proxy
+// of the request's resolver, the default proxy, or that of the HTTP_PROXY
+// environment variables, in that order, once the destination is known not to
+// be blocked. A socks5h proxy resolves host names itself (e.g. Tor),
+// so only destinations given as IP addresses are checked
+func proxyFor(req *http.Request) (*url.URL, error) {
+	resolver, _ := req.Context().Value(resolverKey{}).(string)
+
+	proxyMu.Lock()
+	proxy, exists := proxies[resolver]
+	if exists == false {
+		proxy, exists = proxies[""]
+	}
+	proxyMu.Unlock()
+	if exists == false {
+		var err error
+		if proxy, err = http.ProxyFromEnvironment(req); err != nil {
+			return nil, err
+		}
+	}
+
+	// direct requests are checked as they're dialed, except those to the
+	// address of a proxy, which is dialed unchecked
+	if proxy == nil {
+		port := req.URL.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[req.URL.Scheme]
+		}
+		proxyMu.Lock()
+		proxied := proxyAddrs[net.JoinHostPort(req.URL.Hostname(), port)]
+		proxyMu.Unlock()
+		if proxied {
+			return nil, checkDestination(req.Context(), req.URL.Hostname(),
+				false)
+		}
+		return nil, nil
+	}
+	remote := proxy.Scheme == "socks5h"
+	if err := checkDestination(req.Context(), req.URL.Hostname(),
+		remote); err != nil {
+		return nil, err
+	}
+	proxyMu.Lock()
+	proxyAddrs[proxyAddr(proxy)] = true
+	proxyMu.Unlock()
+	if remote {
+		// the transport's SOCKS5 dialer always leaves resolution to the proxy
+		p := *proxy
+		p.Scheme = "socks5"
+		return &p, nil
+	}
+	return proxy, nil
+}
+
+// blocked reports whether crane may not connect to ip: a private address, or
+// one of blockedIPs, unless it is one of allowedIPs (e.g. an internal proxy)
+func blocked(ip net.IP) bool {
+	for _, n := range allowedIPs {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range blockedIPs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return isPrivateIP(ip)
+}
+
+// lookupIPs resolves host, returning errBlocked, and logging the attempt, if
+// any of its addresses may not be connected to; a host resolving to both
+// public and private addresses is refused altogether
+func lookupIPs(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if blocked(ip) {
+			log.Printf("blocked outbound request to %s (%s)", host, ip)
+			return nil, errBlocked
+		}
+	}
+	return ips, nil
+}
+
+// checkDestination returns errBlocked if host, the destination of a request
+// made through a proxy, is or resolves to an address crane may not connect
+// to; with remote resolution only IP addresses and localhost are checked.
+// The proxy resolves host names again, so this can't prevent DNS rebinding
+// as the direct dial does
+func checkDestination(ctx context.Context, host string, remote bool) error {
+	if net.ParseIP(host) == nil && remote {
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			log.Printf("blocked outbound request to %s", host)
+			return errBlocked
+		}
+		return nil
+	}
+	_, err := lookupIPs(ctx, host)
+	return err
+}
+
+// dialContext is the DialContext of the outbound transport, which blocks
+// connections to local addresses and interfaces (security). Host names are
+// resolved once, and the vetted addresses dialed, so a DNS server can't answer
+// the check with a public address and the dial with a private one; configured
+// proxies may be local, e.g. Tor, and requests through them are checked by
+// proxyFor instead
+func dialContext(ctx context.Context, network, addr string) (net.Conn,
+	error) {
+
+	dialer := net.Dialer{Timeout: timeout}
+	proxyMu.Lock()
+	proxied := proxyAddrs[addr]
+	proxyMu.Unlock()
+	if proxied {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &idleConn{conn, idleTimeout}, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// we could run our check after a dial, but we'd have to discard connect
+	// errors to prevent exposure of local services; a preemptive lookup is
+	// the lesser of two evils, I think
+	ips, err := lookupIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network,
+			net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return &idleConn{conn, idleTimeout}, nil
+		}
+	}
+	return nil, err
+}
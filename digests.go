@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DIGESTS_FILE is the hidden file of papers.Path in which the digests of PDFs
+// without one recorded in their sidecar are cached, so the library isn't hashed
+// again each time it's loaded; entries are keyed by the PDF's path relative to
+// papers.Path and hold only while its size and modification time are unchanged
+const DIGESTS_FILE = ".digests.json"
+
+// CachedDigest is the digest of a PDF as saved to DIGESTS_FILE, along with
+// the size and modification time of the PDF when it was hashed
+type CachedDigest struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// Digests is the cache of PDF digests read from and saved to DIGESTS_FILE
+type Digests struct {
+	sync.Mutex
+	List    map[string]*CachedDigest
+	changed bool
+}
+
+// load replaces the cached digests with those saved in papers.Path; a missing
+// or undecodable file leaves the cache empty, the PDFs being hashed again
+func (d *Digests) load(dir string) {
+	d.Lock()
+	defer d.Unlock()
+	d.List = make(map[string]*CachedDigest)
+	d.changed = false
+	b, err := ioutil.ReadFile(filepath.Join(dir, DIGESTS_FILE))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(b, &d.List); err != nil {
+		log.Printf("%s: %v", DIGESTS_FILE, err)
+		d.List = make(map[string]*CachedDigest)
+	}
+}
+
+// save writes the cached digests to papers.Path if they've changed since they
+// were loaded
+func (d *Digests) save(dir string) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.changed == false {
+		return nil
+	}
+	b, err := json.MarshalIndent(d.List, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".digests-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, DIGESTS_FILE)); err != nil {
+		return err
+	}
+	d.changed = false
+	return nil
+}
+
+// hash returns the digest of the PDF at path, whose key relative to
+// papers.Path is key, from the cache if the PDF is unchanged since it was
+// hashed, or otherwise by hashing it and caching the result
+func (d *Digests) hash(key string, path string, info os.FileInfo) (string,
+	error) {
+	if info == nil {
+		return hashFile(path)
+	}
+	d.Lock()
+	c, exists := d.List[key]
+	d.Unlock()
+	if exists && c.Size == info.Size() && c.ModTime.Equal(info.ModTime()) {
+		return c.SHA256, nil
+	}
+
+	// hashed without the lock held, so other PDFs may be looked up meanwhile
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.List == nil {
+		d.List = make(map[string]*CachedDigest)
+	}
+	d.List[key] = &CachedDigest{info.Size(), info.ModTime(), sum}
+	d.changed = true
+	return sum, nil
+}
+
+// retain drops the cached digests of PDFs no longer in the papers.List set
+// list, or which have since had their digest recorded in their sidecar
+func (d *Digests) retain(list map[string]map[string]*Paper) {
+	d.Lock()
+	defer d.Unlock()
+	for key := range d.List {
+		paper, exists := list[filepath.Dir(key)][key]
+		if exists && (paper.Meta.Provenance == nil ||
+			paper.Meta.Provenance.SHA256 == "") {
+			continue
+		}
+		delete(d.List, key)
+		d.changed = true
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IDLE_TIMEOUT is the default time an outbound connection may go without
+// receiving data before the request is abandoned
+const IDLE_TIMEOUT time.Duration = 30
+
+var (
+	idleTimeout time.Duration
+	maxSizes    = make(map[string]int64) // per-source overrides of maxSize
+	downloads   = Downloads{List: make(map[*Download]struct{})}
+)
+
+// sizeLimit returns the max size of a paper downloaded from source, one of the
+// SOURCE_* constants
+func sizeLimit(source string) int64 {
+	if n := maxSizes[source]; n > 0 {
+		return n
+	}
+	return maxSize
+}
+
+// idleConn is a connection whose reads fail once it has gone idleTimeout
+// without receiving data; unlike a timeout for the whole request, downloads
+// of any size succeed provided they keep making progress
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(b)
+}
+
+// Download is a paper being downloaded
+type Download struct {
+	Received int64     `json:"received"` // updated atomically; keep first
+	Total    int64     `json:"total"`    // Content-Length, or -1 if unknown
+	Limit    int64     `json:"limit"`
+	URL      string    `json:"url"`
+	Source   string    `json:"source"`
+	Category string    `json:"category"` // the paper is being downloaded into
+	Started  time.Time `json:"started"`
+}
+
+// Write counts the bytes of the download received so far
+func (dl *Download) Write(b []byte) (int, error) {
+	atomic.AddInt64(&dl.Received, int64(len(b)))
+	return len(b), nil
+}
+
+// Progress describes the bytes received so far, e.g. "1.2 MB of 8.0 MB (15%)"
+func (dl Download) Progress() string {
+	if dl.Total <= 0 {
+		return formatBytes(dl.Received)
+	}
+	return fmt.Sprintf("%s of %s (%d%%)", formatBytes(dl.Received),
+		formatBytes(dl.Total), dl.Received*100/dl.Total)
+}
+
+// formatBytes returns n in a human-readable form, e.g. 1.2 MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1000000:
+		return fmt.Sprintf("%.1f MB", float64(n)/1000000)
+	case n >= 1000:
+		return fmt.Sprintf("%.1f kB", float64(n)/1000)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// Downloads is the set of papers being downloaded
+type Downloads struct {
+	sync.Mutex
+	List map[*Download]struct{}
+}
+
+// start adds a download of the body of resp, into category, to the set, of
+// total bytes of which received were staged by an earlier attempt
+func (downloads *Downloads) start(resp *http.Response, source string,
+	category string, received int64, total int64) *Download {
+	dl := &Download{
+		Received: received,
+		Total:    total,
+		Limit:    sizeLimit(source),
+		URL:      resp.Request.URL.String(),
+		Source:   source,
+		Category: category,
+		Started:  time.Now(),
+	}
+	downloads.Lock()
+	downloads.List[dl] = struct{}{}
+	downloads.Unlock()
+	return dl
+}
+
+// finish removes a download from the set once it has completed or failed
+func (downloads *Downloads) finish(dl *Download) {
+	downloads.Lock()
+	delete(downloads.List, dl)
+	downloads.Unlock()
+}
+
+// InFlight returns a copy of the downloads in progress into visible
+// categories, oldest first
+func (downloads *Downloads) InFlight(visible func(string) bool) []Download {
+	downloads.Lock()
+	defer downloads.Unlock()
+
+	list := []Download{}
+	// the fields are copied individually, as Received is written by the
+	// downloading goroutine without the lock; the others are set before the
+	// download is registered and not changed after
+	for dl := range downloads.List {
+		if visible(dl.Category) == false {
+			continue
+		}
+		list = append(list, Download{
+			Received: atomic.LoadInt64(&dl.Received),
+			Total:    dl.Total,
+			Limit:    dl.Limit,
+			URL:      dl.URL,
+			Source:   dl.Source,
+			Category: dl.Category,
+			Started:  dl.Started,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// DownloadsHandler renders the progress of downloads in progress into
+// categories the client may view
+func (papers *Papers) DownloadsHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_CONTRIBUTOR)
+	if session == nil {
+		return
+	}
+	res := struct {
+		Downloads []Download
+	}{downloads.InFlight(papers.viewer(r))}
+	downloadsTemp.Execute(w, &res)
+}
+
+// APIDownloadsHandler returns the progress of downloads in progress into
+// categories the client may view as JSON
+func (papers *Papers) APIDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_CONTRIBUTOR)
+	if session == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, downloads.InFlight(papers.viewer(r)))
+}
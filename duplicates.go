@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Duplicate is a set of papers sharing a PDF digest or DOI
+type Duplicate struct {
+	Reason   string // SHA-256 or DOI
+	Value    string
+	Listings []Listing
+}
+
+// DuplicateError is returned when a paper being added duplicates one already in
+// the library
+type DuplicateError struct {
+	Key string // of the paper in the library
+	DOI string // if matched by DOI rather than PDF digest
+}
+
+func (e *DuplicateError) Error() string {
+	if e.DOI != "" {
+		return fmt.Sprintf("paper %q with DOI %q already downloaded", e.Key,
+			e.DOI)
+	}
+	return fmt.Sprintf("paper already downloaded as %q", e.Key)
+}
+
+// hideDuplicate returns err without the key of the paper it reports as
+// duplicated, if the client may not view that paper's category
+func hideDuplicate(err error, visible func(string) bool) error {
+	var dup *DuplicateError
+	if errors.As(err, &dup) && visible(filepath.Dir(dup.Key)) == false {
+		return errors.New("paper already downloaded")
+	}
+	return err
+}
+
+// findDuplicate returns the papers.List key of a paper whose PDF digest
+// matches sum or whose DOI matches doi (case-insensitive), or an empty string
+// if there is none; empty arguments match nothing
+func (papers *Papers) findDuplicate(sum string, doi string) string {
+	papers.RLock()
+	defer papers.RUnlock()
+
+	if key := firstKey(papers.bySum[sum]); sum != "" && key != "" {
+		return key
+	}
+	if key := firstKey(papers.byDOI[strings.ToLower(doi)]); doi != "" &&
+		key != "" {
+		return key
+	}
+	return ""
+}
+
+// firstKey returns the least of keys, so the same duplicate is reported each
+// time, or an empty string if there are none
+func firstKey(keys map[string]bool) string {
+	var first string
+	for key := range keys {
+		if first == "" || key < first {
+			first = key
+		}
+	}
+	return first
+}
+
+// index adds the paper at key in the papers.List set to the digest and DOI
+// indexes; callers hold the lock
+func (papers *Papers) index(key string, paper *Paper) {
+	if papers.bySum == nil {
+		papers.bySum = make(map[string]map[string]bool)
+		papers.byDOI = make(map[string]map[string]bool)
+	}
+	addKey(papers.bySum, paper.SHA256, key)
+	addKey(papers.byDOI, strings.ToLower(paper.Meta.DOI), key)
+}
+
+// unindex removes the paper at key from the digest and DOI indexes, e.g.
+// before it's deleted, moved or its metadata replaced; callers hold the lock
+func (papers *Papers) unindex(key string, paper *Paper) {
+	removeKey(papers.bySum, paper.SHA256, key)
+	removeKey(papers.byDOI, strings.ToLower(paper.Meta.DOI), key)
+}
+
+// addKey records key under value in index; empty values aren't indexed
+func addKey(index map[string]map[string]bool, value string, key string) {
+	if value == "" {
+		return
+	}
+	if _, exists := index[value]; exists == false {
+		index[value] = make(map[string]bool)
+	}
+	index[value][key] = true
+}
+
+// removeKey removes key from under value in index
+func removeKey(index map[string]map[string]bool, value string, key string) {
+	if keys, exists := index[value]; exists {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(index, value)
+		}
+	}
+}
+
+// Duplicates returns the sets of papers in the papers.List set which share a
+// PDF digest or DOI; a set sharing both is reported once, by digest
+func (papers *Papers) Duplicates() []Duplicate {
+	papers.RLock()
+	bySum := make(map[string][]Listing)
+	byDOI := make(map[string][]Listing)
+	for category, set := range papers.List {
+		for key, paper := range set {
+			l := Listing{Key: key, Category: category, Paper: paper}
+			if paper.SHA256 != "" {
+				bySum[paper.SHA256] = append(bySum[paper.SHA256], l)
+			}
+			if paper.Meta.DOI != "" {
+				doi := strings.ToLower(paper.Meta.DOI)
+				byDOI[doi] = append(byDOI[doi], l)
+			}
+		}
+	}
+	papers.RUnlock()
+
+	var dups []Duplicate
+	reported := make(map[string]bool)
+	for sum, listings := range bySum {
+		if len(listings) > 1 {
+			dups = append(dups, Duplicate{"SHA-256", sum, listings})
+			reported[setKey(listings)] = true
+		}
+	}
+	for doi, listings := range byDOI {
+		if len(listings) > 1 && !reported[setKey(listings)] {
+			dups = append(dups, Duplicate{"DOI", doi, listings})
+		}
+	}
+	for _, dup := range dups {
+		sort.Slice(dup.Listings, func(i, j int) bool {
+			return dup.Listings[i].Key < dup.Listings[j].Key
+		})
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		return dups[i].Listings[0].Key < dups[j].Listings[0].Key
+	})
+	return dups
+}
+
+// setKey returns a string uniquely identifying the papers of listings
+// regardless of order
+func setKey(listings []Listing) string {
+	keys := make([]string, len(listings))
+	for i, l := range listings {
+		keys[i] = l.Key
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\x00")
+}
+
+// isDuplicate reports whether a and b share a PDF digest or DOI
+func isDuplicate(a *Paper, b *Paper) bool {
+	return (a.SHA256 != "" && a.SHA256 == b.SHA256) ||
+		(a.Meta.DOI != "" && strings.EqualFold(a.Meta.DOI, b.Meta.DOI))
+}
+
+// hasMeta reports whether meta describes a paper, rather than only recording
+// its digest
+func hasMeta(meta *Meta) bool {
+	return meta.Title != "" || meta.DOI != "" || len(meta.Contributors) > 0
+}
+
+// MergePapers deletes the papers of others, keeping paper; if paper lacks
+// metadata (its sidecar may record only its digest), that of the first other
+// paper with metadata is adopted. Only duplicates of paper, sharing its PDF
+// digest or DOI, may be deleted; if any of others isn't one, none are
+func (papers *Papers) MergePapers(paper string, others []string) error {
+	// the papers are checked under the same lock as they're merged and
+	// deleted, so none can be moved or deleted in between
+	papers.Lock()
+	defer papers.Unlock()
+
+	kept, exists := papers.List[filepath.Dir(paper)][paper]
+	if exists != true {
+		return fmt.Errorf("paper %q does not exist\n", paper)
+	}
+	dups := make(map[string]*Paper)
+	for _, other := range others {
+		if other == paper {
+			continue
+		}
+		dup, exists := papers.List[filepath.Dir(other)][other]
+		if exists != true {
+			return fmt.Errorf("paper %q does not exist\n", other)
+		}
+		if isDuplicate(kept, dup) == false {
+			return fmt.Errorf("paper %q is not a duplicate of %q\n", other,
+				paper)
+		}
+		dups[other] = dup
+	}
+
+	for _, other := range others {
+		dup, exists := dups[other]
+		if exists != true {
+			continue
+		}
+		delete(dups, other) // listed twice
+		if hasMeta(&kept.Meta) == false && hasMeta(&dup.Meta) {
+			// provenance describes the other paper's file, which only
+			// applies if it's identical to the one kept
+			meta := dup.Meta
+			if kept.SHA256 != dup.SHA256 {
+				meta.Provenance = kept.Meta.Provenance
+			}
+			metaPath := filepath.Join(filepath.Dir(kept.PaperPath),
+				kept.PaperName+".meta.xml")
+			if err := writeMeta(&meta, metaPath); err != nil {
+				return err
+			}
+			papers.unindex(paper, kept)
+			kept.Meta = meta
+			kept.MetaPath = metaPath
+			papers.index(paper, kept)
+		}
+		if err := papers.deletePaper(other); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+var (
+	ezproxyURL     string   // starting point URL, e.g. https://login.ezproxy.example.edu/login?url=
+	ezproxyDomains []string // publishers reached through EZproxy; all if empty
+)
+
+// ezproxied returns link, rewritten to be fetched through the institution's
+// EZproxy, if configured for its domain: appended to the starting point URL,
+// or substituted, escaped, for {url} if it contains one (e.g. for qurl=)
+func ezproxied(link string) string {
+	if ezproxyURL == "" {
+		return link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	host := strings.ToLower(u.Hostname())
+	matched := len(ezproxyDomains) == 0
+	for _, d := range ezproxyDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			matched = true
+			break
+		}
+	}
+	if matched == false {
+		return link
+	}
+	if strings.Contains(ezproxyURL, "{url}") {
+		return strings.Replace(ezproxyURL, "{url}", url.QueryEscape(link),
+			-1)
+	}
+	return ezproxyURL + link
+}
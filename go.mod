@@ -2,4 +2,8 @@ module crane
 
 go 1.14
 
-require golang.org/x/net v0.0.0-20210119194325-5f4716e94777
+require (
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+)
@@ -7,32 +7,65 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var templateDir = getTemplateDir()
 
 var funcMap = template.FuncMap{
 	"normalizeStr": normalizeStr,
+	"crumbs":       getCrumbs,
+	"formatTime":   formatTime,
+	"base":         base,
 }
 
-var indexTemp = template.Must(template.New("index.html").Funcs(funcMap).ParseFiles(
-	filepath.Join(templateDir, "layout.html"),
-	filepath.Join(templateDir, "index.html"),
-	filepath.Join(templateDir, "list.html"),
-))
+var (
+	indexTemp       *template.Template
+	categoryTemp    *template.Template
+	paperTemp       *template.Template
+	duplicatesTemp  *template.Template
+	verifyTemp      *template.Template
+	diagnosticsTemp *template.Template
+	downloadsTemp   *template.Template
+	cookiesTemp     *template.Template
+	usersTemp       *template.Template
+	loginTemp       *template.Template
+	tokensTemp      *template.Template
+	adminTemp       *template.Template
+	editTemp        *template.Template
+)
+
+// parseTemplate parses the named template from the templates directory along
+// with the other files it uses, e.g. layout.html
+func parseTemplate(name string, files ...string) *template.Template {
 
-var adminTemp = template.Must(template.New("admin.html").Funcs(funcMap).ParseFiles(
-	filepath.Join(templateDir, "admin.html"),
-	filepath.Join(templateDir, "layout.html"),
-	filepath.Join(templateDir, "list.html"),
-))
+	var paths []string
+	for _, f := range append([]string{name}, files...) {
+		paths = append(paths, filepath.Join(templateDir, f))
+	}
+	return template.Must(template.New(name).Funcs(funcMap).ParseFiles(paths...))
+}
 
-var editTemp = template.Must(template.New("admin-edit.html").Funcs(funcMap).ParseFiles(
-	filepath.Join(templateDir, "admin-edit.html"),
-	filepath.Join(templateDir, "layout.html"),
-	filepath.Join(templateDir, "list.html"),
-))
+// loadTemplates parses the templates of every page; only the server needs
+// them, so subcommands run without a templates directory
+func loadTemplates() {
+
+	indexTemp = parseTemplate("index.html", "layout.html", "list.html", "tree.html")
+	categoryTemp = parseTemplate("category.html", "layout.html", "list.html", "tree.html")
+	paperTemp = parseTemplate("paper.html", "layout.html")
+	duplicatesTemp = parseTemplate("duplicates.html", "layout.html")
+	verifyTemp = parseTemplate("verify.html", "layout.html")
+	diagnosticsTemp = parseTemplate("diagnostics.html", "layout.html")
+	downloadsTemp = parseTemplate("downloads.html", "layout.html")
+	cookiesTemp = parseTemplate("cookies.html", "layout.html")
+	usersTemp = parseTemplate("users.html", "layout.html")
+	loginTemp = parseTemplate("login.html", "layout.html")
+	tokensTemp = parseTemplate("tokens.html", "layout.html")
+	adminTemp = parseTemplate("admin.html", "layout.html", "list.html", "tree.html")
+	editTemp = parseTemplate("admin-edit.html", "layout.html", "list.html")
+}
 
 func normalizeStr(s string) string {
 
@@ -40,6 +73,16 @@ func normalizeStr(s string) string {
 	return strings.Join(strings.Fields(trim), " ")
 }
 
+// formatTime returns t in a human-readable form for templates, or an empty
+// string if unset
+func formatTime(t time.Time) string {
+
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("2006-01-02 15:04:05 MST")
+}
+
 // getTemplateDir returns the absolute path of the templates directory,
 // preferring system-installed assets over the project-local path
 func getTemplateDir() string {
@@ -64,55 +107,215 @@ func (papers *Papers) IndexHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	res := Resp{Papers: *papers}
+	visible := papers.viewer(r)
+	res := Resp{
+		Papers:     papers,
+		Query:      parseQuery(r),
+		Journals:   papers.Journals(visible),
+		Categories: papers.Categories(visible),
+		Tree:       papers.CategoryTree("", visible),
+	}
+	res.Query.allowed = visible
+	res.Listings, res.Pages = papers.Query(res.Query)
 	err := indexTemp.Execute(w, &res)
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
+// CategoryHandler renders the papers of a single category and its
+// subcategories, e.g. /c/foo/bar
+func (papers *Papers) CategoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	category := strings.Trim(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
+	papers.RLock()
+	_, exists := papers.List[category]
+	papers.RUnlock()
+
+	// categories hidden from the client are indistinguishable from those
+	// which don't exist
+	visible := papers.viewer(r)
+	if exists == false || !visible(category) {
+		http.Error(w, http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+	res := Resp{
+		Papers:     papers,
+		Query:      parseQuery(r),
+		Journals:   papers.Journals(visible),
+		Categories: papers.Categories(visible),
+		Tree:       papers.CategoryTree(category, visible),
+		Crumbs:     getCrumbs(category),
+		Category:   category,
+	}
+	res.Query.Category = category
+	res.Query.allowed = visible
+	res.Listings, res.Pages = papers.Query(res.Query)
+	err := categoryTemp.Execute(w, &res)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// PaperHandler renders the metadata and download provenance of a single
+// paper, e.g. /p/Mathematics/example2020.pdf
+func (papers *Papers) PaperHandler(w http.ResponseWriter, r *http.Request) {
+
+	key := strings.TrimPrefix(r.URL.Path, "/p/")
+	category := filepath.Dir(key)
+
+	papers.RLock()
+	paper, exists := papers.List[category][key]
+	papers.RUnlock()
+	if exists == false || !papers.viewer(r)(category) {
+		http.Error(w, http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	// the input and URL of a download may reveal more than the paper, e.g. a
+	// proxy or search, so only those who may add papers are shown them
+	var user *User
+	if session := currentSession(r); session != nil {
+		user = session.User
+	}
+	res := struct {
+		Key      string
+		Category string
+		Crumbs   []Crumb
+		Paper    *Paper
+		User     *User
+	}{key, category, getCrumbs(category), paper, user}
+	err := paperTemp.Execute(w, &res)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// LoginHandler authenticates users with a username and password, beginning a
+// session and returning them to the page which sent them here
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+
+	// only local paths are followed so the login page can't be used to
+	// redirect users to other sites
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") ||
+		strings.HasPrefix(next, "/\\") {
+		next = "/admin/"
+	}
+	if openAccess() {
+		redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	res := struct {
+		Status string
+		Next   string
+		CSRF   string
+	}{Next: next, CSRF: sessions.LoginCSRF(w, r)}
+	if r.Method == http.MethodPost {
+		name := r.PostFormValue("name")
+		addr := clientAddr(r)
+		key := loginKey(addr, name)
+		wait := logins.Wait(key)
+		if d := addrLogins.Wait(addr); d > wait {
+			wait = d
+		}
+		if !sessions.validLoginCSRF(r) {
+			w.WriteHeader(http.StatusForbidden)
+			res.Status = "invalid or missing CSRF token; please try again"
+		} else if wait > 0 {
+			secs := int(wait/time.Second) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			w.WriteHeader(http.StatusTooManyRequests)
+			res.Status = fmt.Sprintf("too many failed logins; try again in "+
+				"%s", time.Duration(secs)*time.Second)
+		} else if u := checkCredentials(name,
+			r.PostFormValue("password")); u != nil {
+			// the address isn't forgiven, so one account can't be used to
+			// clear the failures of guessing others
+			logins.Reset(key)
+			sessions.New(w, r, u.Name)
+			redirect(w, r, next, http.StatusSeeOther)
+			return
+		} else {
+			logins.Fail(key)
+			addrLogins.Fail(addr)
+			log.Printf("failed login for %q from %s", name, addr)
+			w.WriteHeader(http.StatusUnauthorized)
+			res.Status = "invalid username or password"
+		}
+	}
+	loginTemp.Execute(w, &res)
+}
+
+// LogoutHandler ends the user's session
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if session := sessions.Get(r); session == nil || !session.validCSRF(r) {
+		http.Error(w, "invalid or missing CSRF token", http.StatusForbidden)
+		return
+	}
+	sessions.Delete(w, r)
+	redirect(w, r, "/", http.StatusSeeOther)
+}
+
 // AdminHandler renders the index of papers stored in papers.Path with
 // additional forms to modify the collection (add, delete, rename...)
 func (papers *Papers) AdminHandler(w http.ResponseWriter, r *http.Request) {
 
-	res := Resp{Papers: *papers}
-	if user != "" && pass != "" {
-		username, password, ok := r.BasicAuth()
-		if ok && user == username && pass == password {
-			adminTemp.Execute(w, &res)
-		} else {
-			w.Header().Add("WWW-Authenticate",
-				`Basic realm="Please authenticate"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized),
-				http.StatusUnauthorized)
-		}
-	} else {
-		adminTemp.Execute(w, &res)
+	session := authorize(w, r, ROLE_VIEWER)
+	if session == nil {
+		return
 	}
+	visible := papers.viewer(r)
+	res := Resp{
+		Papers:     papers,
+		User:       session.User,
+		CSRF:       session.CSRF,
+		Query:      parseQuery(r),
+		Journals:   papers.Journals(visible),
+		Categories: papers.Categories(visible),
+		Tree:       papers.CategoryTree("", visible),
+	}
+	res.Query.allowed = visible
+	res.Listings, res.Pages = papers.Query(res.Query)
+	adminTemp.Execute(w, &res)
 }
 
 // EditHandler renders the index of papers stored in papers.Path, prefixing
 // a checkbox to each unique paper and category for modification
 func (papers *Papers) EditHandler(w http.ResponseWriter, r *http.Request) {
 
-	res := Resp{Papers: *papers}
-	if user != "" && pass != "" {
-		username, password, ok := r.BasicAuth()
-		if !ok || user != username || pass != password {
-			w.Header().Add("WWW-Authenticate",
-				`Basic realm="Please authenticate"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized),
-				http.StatusUnauthorized)
-			return
-		}
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
 	}
+	// the page lists only the categories and papers the session may view,
+	// e.g. those of a restricted API token
+	visible := papers.viewer(r)
+	res := Resp{Papers: papers, User: session.User, CSRF: session.CSRF}
 	if err := r.ParseForm(); err != nil {
 		res.Status = err.Error()
+		res.Visible = papers.Visible(visible)
 		editTemp.Execute(w, &res)
 		return
 	}
-	if action := r.FormValue("action"); action == "delete" {
-		for _, paper := range r.Form["paper"] {
+
+	// API tokens may be restricted to certain categories; every category
+	// touched by the request (source and destination) must be permitted
+	if !permitted(session, r) {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+	if action := r.PostFormValue("action"); action == "delete" {
+		for _, paper := range r.PostForm["paper"] {
 			if res.Status != "" {
 				break
 			}
@@ -120,7 +323,7 @@ func (papers *Papers) EditHandler(w http.ResponseWriter, r *http.Request) {
 				res.Status = err.Error()
 			}
 		}
-		for _, category := range r.Form["category"] {
+		for _, category := range r.PostForm["category"] {
 			if res.Status != "" {
 				break
 			}
@@ -133,7 +336,7 @@ func (papers *Papers) EditHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if strings.HasPrefix(action, "move") {
 		destCategory := strings.SplitN(action, "move-", 2)[1]
-		for _, paper := range r.Form["paper"] {
+		for _, paper := range r.PostForm["paper"] {
 			if res.Status != "" {
 				break
 			}
@@ -145,8 +348,8 @@ func (papers *Papers) EditHandler(w http.ResponseWriter, r *http.Request) {
 			res.Status = "move successful"
 		}
 	} else {
-		rc := r.FormValue("rename-category")
-		rt := r.FormValue("rename-to")
+		rc := r.PostFormValue("rename-category")
+		rt := r.PostFormValue("rename-to")
 		if rc != "" && rt != "" {
 			// ensure filesystem safety of category names
 			rc = strings.Trim(strings.Replace(rc, "..", "", -1), "/.")
@@ -159,36 +362,108 @@ func (papers *Papers) EditHandler(w http.ResponseWriter, r *http.Request) {
 				res.Status = "rename successful"
 			}
 		}
+
+		// an empty move-to (top level) is valid, so only the category
+		// selection is required
+		mc := r.PostFormValue("move-category")
+		mt := r.PostFormValue("move-to")
+		if mc != "" {
+			mc = strings.Trim(strings.Replace(mc, "..", "", -1), "/.")
+			mt = strings.Trim(strings.Replace(mt, "..", "", -1), "/.")
+
+			if err := papers.MoveCategory(mc, mt); err != nil {
+				res.Status = err.Error()
+			}
+			if res.Status == "" {
+				res.Status = "move successful"
+			}
+		}
+
+		// an empty access-level removes the category's ACCESS_FILE so it
+		// inherits the visibility of its parent
+		if ac := r.PostFormValue("access-category"); ac != "" {
+			var access *Access
+			var err error
+			if al := r.PostFormValue("access-level"); al != "" {
+				access, err = parseAccess(al + " " +
+					r.PostFormValue("access-users"))
+			}
+			if err == nil {
+				err = papers.SetAccess(ac, access)
+			}
+			if err != nil {
+				res.Status = err.Error()
+			} else {
+				res.Status = fmt.Sprintf("visibility of %q set to %s", ac,
+					papers.GetAccess(ac))
+			}
+		}
 	}
+	res.Visible = papers.Visible(visible)
 	editTemp.Execute(w, &res)
 }
 
+// permitted reports whether the session may act on every category touched by
+// an EditHandler request, both sources and destinations
+func permitted(session *Session, r *http.Request) bool {
+
+	var touched []string
+	touched = append(touched, r.PostForm["category"]...)
+	for _, paper := range r.PostForm["paper"] {
+		touched = append(touched, filepath.Dir(paper))
+	}
+	if action := r.PostFormValue("action"); strings.HasPrefix(action, "move-") {
+		touched = append(touched, strings.TrimPrefix(action, "move-"))
+	}
+	for _, category := range []string{r.PostFormValue("rename-category"),
+		r.PostFormValue("rename-to"), r.PostFormValue("move-category"),
+		r.PostFormValue("access-category")} {
+		if category != "" {
+			touched = append(touched, category)
+		}
+	}
+
+	// an empty move-to is the top level, which is outside any restriction
+	if r.PostFormValue("move-category") != "" {
+		touched = append(touched, r.PostFormValue("move-to"))
+	}
+	for _, category := range touched {
+		if !session.Allowed(strings.Trim(category, "/.")) {
+			return false
+		}
+	}
+	return true
+}
+
 // AddHandler provides support for new paper processing and category addition
 func (papers *Papers) AddHandler(w http.ResponseWriter, r *http.Request) {
 
-	if user != "" && pass != "" {
-		username, password, ok := r.BasicAuth()
-		if !ok || user != username || pass != password {
-			w.Header().Add("WWW-Authenticate",
-				`Basic realm="Please authenticate"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized),
-				http.StatusUnauthorized)
-			return
-		}
+	session := authorize(w, r, ROLE_CONTRIBUTOR)
+	if session == nil {
+		return
 	}
-	p := r.FormValue("dl-paper")
-	c := r.FormValue("dl-category")
-	nc := r.FormValue("new-category")
+	p := r.PostFormValue("dl-paper")
+	c := r.PostFormValue("dl-category")
+	nc := r.PostFormValue("new-category")
 
 	// sanitize input; we use the category to build the path used to save
 	// papers
 	nc = strings.Trim(strings.Replace(nc, "..", "", -1), "/.")
-	res := Resp{}
+	res := Resp{User: session.User, CSRF: session.CSRF}
+
+	// categories hidden from the client, or outside an API token's
+	// categories, may not be added to
+	visible := papers.viewer(r)
+	if (c != "" && !visible(c)) || (nc != "" && !visible(nc)) {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
 
 	// paper download, both required fields populated
 	if len(strings.TrimSpace(p)) > 0 && len(strings.TrimSpace(c)) > 0 {
 		if paper, err := papers.ProcessAddPaperInput(c, p); err != nil {
-			res.Status = err.Error()
+			res.Status = hideDuplicate(err, visible).Error()
 		} else {
 			if paper.Meta.Title != "" {
 				res.Status = fmt.Sprintf("%q downloaded successfully",
@@ -204,29 +479,245 @@ func (papers *Papers) AddHandler(w http.ResponseWriter, r *http.Request) {
 	} else if len(strings.TrimSpace(nc)) > 0 {
 		// accounts for nested category addition; e.g. "foo/bar/baz" where
 		// "foo/bar" and/or "foo" do not already exist
-		n := nc
-		for n != "." {
-			_, exists := papers.List[n]
-			if exists == true {
-				res.Status = fmt.Sprintf("category %q already exists", n)
-			} else if err := os.MkdirAll(filepath.Join(papers.Path, n),
-				os.ModePerm); err != nil {
-				res.Status = fmt.Sprintf(err.Error())
-			} else {
-				papers.List[n] = make(map[string]*Paper)
-			}
-			if res.Status != "" {
+		papers.RLock()
+		_, exists := papers.List[nc]
+		papers.RUnlock()
+		if exists == true {
+			res.Status = fmt.Sprintf("category %q already exists", nc)
+		} else if err := papers.NewCategory(nc); err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = fmt.Sprintf("category %q added successfully", nc)
+			res.LastUsedCategory = nc
+		}
+	}
+	res.Papers = papers
+	res.Query = parseQuery(r)
+	res.Query.allowed = visible
+	res.Journals = papers.Journals(visible)
+	res.Categories = papers.Categories(visible)
+	res.Tree = papers.CategoryTree("", visible)
+	res.Listings, res.Pages = papers.Query(res.Query)
+	adminTemp.Execute(w, &res)
+}
+
+// DuplicatesHandler renders the sets of papers sharing a PDF digest or DOI,
+// permitting duplicates to be deleted or merged into a single paper
+func (papers *Papers) DuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
+	}
+	res := struct {
+		Status     string
+		CSRF       string
+		Duplicates []Duplicate
+	}{CSRF: session.CSRF}
+	if err := r.ParseForm(); err != nil {
+		res.Status = err.Error()
+	} else if session.Token != nil && len(session.Token.Categories) > 0 {
+		// duplicates span categories, which restricted tokens can't see
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	} else if action := r.PostFormValue("action"); action == "delete" {
+		for _, paper := range r.PostForm["paper"] {
+			if err := papers.DeletePaper(paper); err != nil {
+				res.Status = err.Error()
 				break
 			}
-			res.LastUsedCategory = n
-			n = filepath.Dir(n)
 		}
 		if res.Status == "" {
-			res.Status = fmt.Sprintf("category %q added successfully", nc)
+			res.Status = "delete successful"
+		}
+	} else if action == "merge" {
+		if keep := r.PostFormValue("keep"); keep == "" {
+			res.Status = "no paper selected to keep"
+		} else if err := papers.MergePapers(keep,
+			r.PostForm["set"]); err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = "merge successful"
 		}
 	}
-	res.Papers = *papers
-	adminTemp.Execute(w, &res)
+	res.Duplicates = papers.Duplicates()
+	duplicatesTemp.Execute(w, &res)
+}
+
+// VerifyHandler renders the problems found in the library's files by Verify,
+// permitting the selected problems to be repaired
+func (papers *Papers) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
+	}
+	res := struct {
+		Status   []string
+		CSRF     string
+		Problems []Problem
+	}{CSRF: session.CSRF}
+	if err := r.ParseForm(); err != nil {
+		res.Status = append(res.Status, err.Error())
+	} else if session.Token != nil && len(session.Token.Categories) > 0 {
+		// problems span categories, which restricted tokens can't see
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	} else if r.PostFormValue("action") == "repair" {
+		// only problems found now are repaired, so the form can't be used to
+		// quarantine arbitrary files
+		selected := make(map[string]bool)
+		for _, path := range r.PostForm["path"] {
+			selected[path] = true
+		}
+
+		// the library is verified once; afterwards only the repaired files
+		// (and their PDFs or sidecars, which are moved along with them) are
+		// checked again, rather than hashing the whole library a second time
+		problems := papers.Verify()
+		repaired := make(map[string]bool)
+		for _, p := range problems {
+			if selected[p.Path] == false {
+				continue
+			}
+			if done, err := papers.Repair(p); err != nil {
+				res.Status = append(res.Status, p.Path+": "+err.Error())
+			} else {
+				res.Status = append(res.Status, p.Path+": "+done)
+			}
+			base := strings.TrimSuffix(strings.TrimSuffix(p.Path, ".pdf"),
+				".meta.xml")
+			repaired[p.Path] = true
+			repaired[base+".pdf"] = true
+			repaired[base+".meta.xml"] = true
+		}
+		var paths []string
+		for path := range repaired {
+			paths = append(paths, path)
+		}
+		for _, p := range problems {
+			if repaired[p.Path] == false {
+				res.Problems = append(res.Problems, p)
+			}
+		}
+		res.Problems = append(res.Problems, papers.VerifyPaths(paths)...)
+		sortProblems(res.Problems)
+		verifyTemp.Execute(w, &res)
+		return
+	}
+	res.Problems = papers.Verify()
+	verifyTemp.Execute(w, &res)
+}
+
+// UsersHandler renders the accounts permitted to access the admin endpoints
+// with forms to add, update and delete them
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
+	}
+	if session.Token != nil {
+		http.Error(w, "accounts can't be managed with API tokens",
+			http.StatusForbidden)
+		return
+	}
+	res := struct {
+		Status string
+		CSRF   string
+		Users  []*User
+		Roles  []Role
+	}{CSRF: session.CSRF}
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	switch r.PostFormValue("action") {
+	case "set":
+		role, err := parseRole(r.PostFormValue("role"))
+		if err == nil {
+			err = users.SetUser(name, r.PostFormValue("password"), role)
+		}
+		if err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = fmt.Sprintf("user %q saved", name)
+		}
+	case "delete":
+		if err := users.DeleteUser(name); err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = fmt.Sprintf("user %q deleted", name)
+		}
+	}
+	res.Users = users.Sorted()
+	res.Roles = []Role{ROLE_VIEWER, ROLE_CONTRIBUTOR, ROLE_ADMIN}
+	usersTemp.Execute(w, &res)
+}
+
+// TokensHandler renders the API tokens of the user, or every token for
+// admins, with forms to create and revoke them
+func (papers *Papers) TokensHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_VIEWER)
+	if session == nil {
+		return
+	}
+	if session.Token != nil {
+		http.Error(w, "tokens can't be managed with API tokens",
+			http.StatusForbidden)
+		return
+	}
+	visible := papers.viewer(r)
+	res := struct {
+		Status     string
+		Secret     string
+		CSRF       string
+		User       *User
+		Categories []string // visible to the user, to restrict tokens to
+		Tokens     []*Token
+	}{CSRF: session.CSRF, User: session.User,
+		Categories: papers.Categories(visible)}
+
+	// admins may revoke any token, others only their own
+	owner := session.User.Name
+	if session.User.CanManage() {
+		owner = ""
+	}
+	if err := r.ParseForm(); err != nil {
+		res.Status = err.Error()
+	}
+	switch r.PostFormValue("action") {
+	case "create":
+		var categories []string
+		var err error
+		for _, c := range r.PostForm["category"] {
+			if c != "" && visible(c) == false {
+				err = fmt.Errorf("category %q does not exist", c)
+			} else if c != "" {
+				categories = append(categories, c)
+			}
+		}
+		var secret string
+		if err == nil {
+			_, secret, err = tokens.NewToken(session.User.Name,
+				r.PostFormValue("name"), r.PostForm["scope"], categories)
+		}
+		if err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = "token created; copy it now, it won't be shown again"
+			res.Secret = secret
+		}
+	case "revoke":
+		if err := tokens.RevokeToken(r.PostFormValue("id"),
+			owner); err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = "token revoked"
+		}
+	}
+	res.Tokens = tokens.Sorted(owner)
+	tokensTemp.Execute(w, &res)
 }
 
 // DownloadHandler serves saved papers up for download
@@ -236,20 +727,18 @@ func (papers *Papers) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	category := filepath.Dir(paper)
 
 	// return 404 if the provided paper category or paper key do not exist in
-	// the papers set
-	if _, exists := papers.List[category]; exists == false {
-		http.Error(w, http.StatusText(http.StatusNotFound),
-			http.StatusNotFound)
-		return
-	}
-	if _, exists := papers.List[category][paper]; exists == false {
+	// the papers set, or the category is hidden from the client
+	papers.RLock()
+	p, exists := papers.List[category][paper]
+	papers.RUnlock()
+	if exists == false || !papers.viewer(r)(category) {
 		http.Error(w, http.StatusText(http.StatusNotFound),
 			http.StatusNotFound)
 		return
 	}
 
 	// ensure the paper (PaperPath) actually exists on the filesystem
-	i, err := os.Stat(papers.List[category][paper].PaperPath)
+	i, err := os.Stat(p.PaperPath)
 	if os.IsNotExist(err) {
 		http.Error(w, http.StatusText(http.StatusNotFound),
 			http.StatusNotFound)
@@ -257,6 +746,6 @@ func (papers *Papers) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusForbidden),
 			http.StatusForbidden)
 	} else {
-		http.ServeFile(w, r, papers.List[category][paper].PaperPath)
+		http.ServeFile(w, r, p.PaperPath)
 	}
 }
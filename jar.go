@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// COOKIES_FILE is the hidden file of papers.Path to which the outbound cookie
+// jar is saved, so cookies survive restarts; session cookies, which have no
+// expiry of their own, are kept for SESSION_COOKIE_TTL
+const (
+	COOKIES_FILE       = ".cookies.json"
+	SESSION_COOKIE_TTL = 7 * 24 * time.Hour
+)
+
+var jar *Jar
+
+// StoredCookie is a cookie of the jar as saved to COOKIES_FILE, along with the
+// URL which set it
+type StoredCookie struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain,omitempty"` // empty for host-only cookies
+	Path     string    `json:"path,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"` // zero for session cookies
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// expired reports whether the cookie has expired by now
+func (c *StoredCookie) expired(now time.Time) bool {
+	if c.Expires.IsZero() {
+		return !c.Created.IsZero() && c.Created.Add(SESSION_COOKIE_TTL).Before(now)
+	}
+	return c.Expires.Before(now)
+}
+
+// host returns the domain the cookie is sent to, e.g. example.org
+func (c *StoredCookie) host() string {
+	if c.Domain != "" {
+		return strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// path returns the path the cookie is sent to: its Path attribute, or else
+// the directory of the URL which set it, e.g. /a for /a/b
+func (c *StoredCookie) path() string {
+	if strings.HasPrefix(c.Path, "/") {
+		return c.Path
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return "/"
+	}
+	if i := strings.LastIndex(u.Path, "/"); i > 0 {
+		return u.Path[:i]
+	}
+	return "/"
+}
+
+// key identifies the cookie; one set with the same key replaces it
+func (c *StoredCookie) key() string {
+	return c.host() + ";" + c.path() + ";" + c.Name
+}
+
+// cookie returns the cookie as set by its URL
+func (c *StoredCookie) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+}
+
+// Jar is the http.CookieJar of the outbound client; it keeps a record of the
+// cookies set in a cookiejar.Jar, which can't be enumerated, so they may be
+// saved to Path and set again when crane restarts
+type Jar struct {
+	sync.Mutex
+	Path   string
+	Stored map[string]*StoredCookie // by key
+	jar    *cookiejar.Jar
+	info   os.FileInfo // of the file at Path when last read or written
+}
+
+// NewJar returns an empty jar which isn't saved
+func NewJar() *Jar {
+	j := &Jar{Stored: make(map[string]*StoredCookie)}
+	j.reset()
+	return j
+}
+
+// reset replaces the cookiejar.Jar with an empty one
+func (j *Jar) reset() {
+	var err error
+	j.jar, err = cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SetCookies implements http.CookieJar
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Lock()
+	defer j.Unlock()
+
+	// cookies imported or cleared by another process since are kept
+	j.sync()
+	j.jar.SetCookies(u, cookies)
+	for _, c := range cookies {
+		j.record(u, c)
+	}
+	if err := j.save(); err != nil {
+		log.Printf("saving cookies: %v", err)
+	}
+}
+
+// Cookies implements http.CookieJar
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	j.Lock()
+	defer j.Unlock()
+	j.sync()
+	return j.jar.Cookies(u)
+}
+
+// record adds the cookie set by u to the record of the jar, or removes it if
+// the cookie has expired; callers hold the lock
+func (j *Jar) record(u *url.URL, c *http.Cookie) {
+	// the path of the URL is kept, as it's the default path of the cookie
+	s := &StoredCookie{
+		URL: (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path,
+			RawPath: u.RawPath}).String(),
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		Created:  time.Now(),
+	}
+	if c.MaxAge > 0 {
+		s.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+	}
+	if c.MaxAge < 0 || s.expired(time.Now()) {
+		delete(j.Stored, s.key())
+		return
+	}
+	j.Stored[s.key()] = s
+}
+
+// Open loads the jar saved at path, which it's saved to from now on
+func (j *Jar) Open(path string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	j.Path = path
+	n, err := j.load()
+	if err != nil {
+		return err
+	}
+	if len(j.Stored) < n {
+		return j.save()
+	}
+	return nil
+}
+
+// load replaces the cookies of the jar with those saved at Path, returning
+// the number saved, expired ones included; callers hold the lock
+func (j *Jar) load() (int, error) {
+	info, err := os.Stat(j.Path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadFile(j.Path)
+	if err != nil {
+		return 0, err
+	}
+	var cookies []*StoredCookie
+	if err := json.Unmarshal(b, &cookies); err != nil {
+		return 0, fmt.Errorf("%s: %v", j.Path, err)
+	}
+	j.reset()
+	j.Stored = make(map[string]*StoredCookie)
+	now := time.Now()
+	for _, c := range cookies {
+		if c.expired(now) == false {
+			j.set(c)
+		}
+	}
+	j.info = info
+	return len(cookies), nil
+}
+
+// sync reloads the jar if the file at Path has changed since it was last read
+// or written, e.g. by crane cookies import or clear; every change made by
+// this process is saved at once, so none are lost. Callers hold the lock
+func (j *Jar) sync() {
+	if j.Path == "" {
+		return
+	}
+	info, err := os.Stat(j.Path)
+	if err != nil {
+		return
+	}
+	// the file is replaced on every save, so it's a different file once
+	// changed, even within the resolution of modification times
+	if j.info != nil && os.SameFile(info, j.info) &&
+		info.ModTime().Equal(j.info.ModTime()) &&
+		info.Size() == j.info.Size() {
+		return
+	}
+	if _, err := j.load(); err != nil {
+		log.Printf("reloading cookies: %v", err)
+	}
+}
+
+// set adds a stored cookie to the jar; callers hold the lock
+func (j *Jar) set(c *StoredCookie) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return
+	}
+	j.jar.SetCookies(u, []*http.Cookie{c.cookie()})
+	j.Stored[c.key()] = c
+}
+
+// save writes the jar to Path, if set, readable by its owner only, as the
+// cookies may authenticate crane; expired cookies are dropped. Callers hold
+// the lock
+func (j *Jar) save() error {
+	if j.Path == "" {
+		return nil
+	}
+	now := time.Now()
+	for key, c := range j.Stored {
+		if c.expired(now) {
+			delete(j.Stored, key)
+		}
+	}
+	b, err := json.MarshalIndent(j.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.Path), ".cookies-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.Path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(j.Path); err == nil {
+		j.info = info
+	}
+	return nil
+}
+
+// sorted returns the cookies of the jar ordered by domain, path and name;
+// callers hold the lock
+func (j *Jar) sorted() []*StoredCookie {
+	cookies := []*StoredCookie{}
+	for _, c := range j.Stored {
+		cookies = append(cookies, c)
+	}
+	sort.Slice(cookies, func(i, k int) bool {
+		return cookies[i].key() < cookies[k].key()
+	})
+	return cookies
+}
+
+// List returns a copy of the cookies of the jar ordered by domain
+func (j *Jar) List() []StoredCookie {
+	j.Lock()
+	defer j.Unlock()
+	j.sync()
+
+	var list []StoredCookie
+	for _, c := range j.sorted() {
+		list = append(list, *c)
+	}
+	return list
+}
+
+// CookieDomain is a domain with cookies in the jar
+type CookieDomain struct {
+	Domain  string    `json:"domain"`
+	Cookies int       `json:"cookies"`
+	Expires time.Time `json:"expires"` // of the last to expire; zero if session
+}
+
+// Domains returns the domains with cookies in the jar, in order
+func (j *Jar) Domains() []CookieDomain {
+	j.Lock()
+	defer j.Unlock()
+	j.sync()
+
+	var domains []CookieDomain
+	for _, c := range j.sorted() {
+		n := len(domains)
+		if n == 0 || domains[n-1].Domain != c.host() {
+			domains = append(domains, CookieDomain{Domain: c.host()})
+			n++
+		}
+		d := &domains[n-1]
+		d.Cookies++
+		if c.Expires.After(d.Expires) {
+			d.Expires = c.Expires
+		}
+	}
+	return domains
+}
+
+// Clear removes the cookies of domain and its subdomains from the jar,
+// returning the number removed, e.g. to renegotiate a publisher's session
+func (j *Jar) Clear(domain string) (int, error) {
+	j.Lock()
+	defer j.Unlock()
+	j.sync()
+
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	var kept []*StoredCookie
+	n := 0
+	for _, c := range j.sorted() {
+		if h := c.host(); h == domain || strings.HasSuffix(h, "."+domain) {
+			n++
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	// a cookiejar.Jar can't delete cookies, so the remainder are set again in
+	// an empty one
+	j.reset()
+	j.Stored = make(map[string]*StoredCookie)
+	for _, c := range kept {
+		j.set(c)
+	}
+	return n, j.save()
+}
+
+// CookiesHandler renders the domains with cookies in the outbound cookie jar,
+// with forms to clear them
+func CookiesHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := authorize(w, r, ROLE_ADMIN)
+	if session == nil {
+		return
+	}
+	if session.Token != nil {
+		http.Error(w, "cookies can't be managed with API tokens",
+			http.StatusForbidden)
+		return
+	}
+	res := struct {
+		Status  string
+		CSRF    string
+		Domains []CookieDomain
+	}{CSRF: session.CSRF}
+	if r.PostFormValue("action") == "clear" {
+		domain := r.PostFormValue("domain")
+		if n, err := jar.Clear(domain); err != nil {
+			res.Status = err.Error()
+		} else {
+			res.Status = fmt.Sprintf("cleared %d cookies of %s", n, domain)
+		}
+	}
+	res.Domains = jar.Domains()
+	cookiesTemp.Execute(w, &res)
+}
+
+// Import adds the cookies of a Netscape cookies.txt file, as exported from a
+// browser, to the jar, e.g. those of an institution's EZproxy session; only
+// those of domain and its subdomains are imported, unless domain is empty
+func (j *Jar) Import(r io.Reader, domain string) (int, error) {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	var cookies []*StoredCookie
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c, err := parseCookieLine(line, httpOnly)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %v", n, err)
+		}
+		if h := c.host(); domain != "" && h != domain &&
+			!strings.HasSuffix(h, "."+domain) {
+			continue
+		}
+		if c.Created = time.Now(); c.expired(c.Created) {
+			continue
+		}
+		cookies = append(cookies, c)
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	j.sync()
+	for _, c := range cookies {
+		j.set(c)
+	}
+	return len(cookies), j.save()
+}
+
+// parseCookieLine parses a line of a cookies.txt file: the tab-separated
+// domain, whether subdomains are included, path, secure, expiry (seconds
+// since the epoch, or 0 for a session cookie), name and value
+func parseCookieLine(line string, httpOnly bool) (*StoredCookie, error) {
+	v := strings.Split(line, "\t")
+	if len(v) == 6 {
+		v = append(v, "") // cookies without a value
+	}
+	if len(v) != 7 {
+		return nil, fmt.Errorf("expected 7 tab-separated fields, found %d",
+			len(v))
+	}
+	expiry, err := strconv.ParseInt(v[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry %q", v[4])
+	}
+	host := strings.TrimPrefix(v[0], ".")
+	secure := strings.EqualFold(v[3], "TRUE")
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	c := &StoredCookie{
+		URL:      scheme + "://" + host + "/",
+		Name:     v[5],
+		Value:    v[6],
+		Path:     v[2],
+		Secure:   secure,
+		HttpOnly: httpOnly,
+	}
+	if strings.EqualFold(v[1], "TRUE") {
+		c.Domain = host
+	}
+	if expiry > 0 {
+		c.Expires = time.Unix(expiry, 0)
+	}
+	return c, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openJar returns a jar saved at path
+func openJar(t *testing.T, path string) *Jar {
+	j := NewJar()
+	if err := j.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJarKeepsChangesOfOtherProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-jar-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, COOKIES_FILE)
+
+	server := openJar(t, path)
+	u, _ := url.Parse("https://a.example.org/")
+	server.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}})
+
+	// e.g. crane cookies import, while the server is running
+	cli := openJar(t, path)
+	if _, err := cli.Import(strings.NewReader(
+		"b.example.org\tFALSE\t/\tTRUE\t0\tb\t2\n"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ = url.Parse("https://c.example.org/")
+	server.SetCookies(u, []*http.Cookie{{Name: "c", Value: "3"}})
+
+	var names []string
+	for _, c := range openJar(t, path).List() {
+		names = append(names, c.Name)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Fatalf("saved cookies %s, want a,b,c", got)
+	}
+	u, _ = url.Parse("https://b.example.org/")
+	if cookies := server.Cookies(u); len(cookies) != 1 {
+		t.Fatalf("imported cookie not sent by the server: %v", cookies)
+	}
+
+	// e.g. crane cookies clear
+	if _, err := cli.Clear("a.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse("https://a.example.org/")
+	if cookies := server.Cookies(u); len(cookies) != 0 {
+		t.Fatalf("cleared cookie still sent by the server: %v", cookies)
+	}
+}
+
+func TestJarKeepsDefaultPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-jar-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, COOKIES_FILE)
+
+	// a cookie without a Path attribute is sent beneath the directory of the
+	// URL which set it, after a restart too
+	u, _ := url.Parse("https://example.org/login/form?next=x")
+	openJar(t, path).SetCookies(u, []*http.Cookie{{Name: "s", Value: "1"}})
+	j := openJar(t, path)
+	for _, tt := range []struct {
+		url  string
+		sent bool
+	}{
+		{"https://example.org/login/other", true},
+		{"https://example.org/login", true},
+		{"https://example.org/", false},
+		{"https://example.org/logout", false},
+	} {
+		u, _ := url.Parse(tt.url)
+		if sent := len(j.Cookies(u)) == 1; sent != tt.sent {
+			t.Errorf("%s: cookie sent = %v, want %v", tt.url, sent, tt.sent)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PER_PAGE     int = 50  // default number of papers listed per page
+	MAX_PER_PAGE int = 500 // max number of papers listed per page
+)
+
+// Query describes the sorting, filtering and page of papers requested by a
+// client, e.g. /?sort=year&order=desc&from=2000&page=2
+type Query struct {
+	Sort     string // category, title, author, year, journal or added
+	Order    string // asc or desc
+	YearFrom int
+	YearTo   int
+	Journal  string
+	Category string // limits results to the category and its subcategories
+	Page     int
+	PerPage  int
+
+	// allowed, if set, limits results to the categories it permits
+	allowed func(category string) bool
+}
+
+// Listing is a paper and its papers.List keys as displayed in a list
+type Listing struct {
+	Key      string // e.g. Mathematics/example2020.pdf
+	Category string // e.g. Mathematics
+	Paper    *Paper
+}
+
+// Pages describes the position of the current page of listings
+type Pages struct {
+	Page  int `json:"page"`
+	Count int `json:"count"` // number of pages
+	Total int `json:"total"` // number of listings across all pages
+	Prev  int `json:"prev"`  // zero if there is no previous page
+	Next  int `json:"next"`  // zero if there is no next page
+}
+
+// parseQuery returns the Query described by the request's URL parameters,
+// falling back to defaults for missing or invalid values
+func parseQuery(r *http.Request) Query {
+
+	v := r.URL.Query()
+	q := Query{
+		Sort:     v.Get("sort"),
+		Order:    v.Get("order"),
+		Journal:  v.Get("journal"),
+		Category: strings.Trim(v.Get("category"), "/"),
+	}
+	switch q.Sort {
+	case "title", "author", "year", "journal", "added":
+	default:
+		q.Sort = "category"
+	}
+	if q.Order != "desc" {
+		q.Order = "asc"
+	}
+	q.YearFrom, _ = strconv.Atoi(v.Get("from"))
+	q.YearTo, _ = strconv.Atoi(v.Get("to"))
+	if q.Page, _ = strconv.Atoi(v.Get("page")); q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PerPage, _ = strconv.Atoi(v.Get("per")); q.PerPage < 1 {
+		q.PerPage = PER_PAGE
+	} else if q.PerPage > MAX_PER_PAGE {
+		q.PerPage = MAX_PER_PAGE
+	}
+	return q
+}
+
+// PageURL returns the query string of q with its page set to page; used by
+// templates to build pagination links
+func (q Query) PageURL(page int) string {
+
+	v := url.Values{}
+	if q.Sort != "category" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Order != "asc" {
+		v.Set("order", q.Order)
+	}
+	if q.YearFrom != 0 {
+		v.Set("from", strconv.Itoa(q.YearFrom))
+	}
+	if q.YearTo != 0 {
+		v.Set("to", strconv.Itoa(q.YearTo))
+	}
+	if q.Journal != "" {
+		v.Set("journal", q.Journal)
+	}
+	if q.Category != "" {
+		v.Set("category", q.Category)
+	}
+	if q.PerPage != PER_PAGE {
+		v.Set("per", strconv.Itoa(q.PerPage))
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return "?" + v.Encode()
+}
+
+// getFirstAuthor returns the last name of the paper's first author
+func getFirstAuthor(m *Meta) string {
+
+	for _, contributor := range m.Contributors {
+		if contributor.Sequence == "first" {
+			return contributor.LastName
+		}
+	}
+	if len(m.Contributors) > 0 {
+		return m.Contributors[0].LastName
+	}
+	return ""
+}
+
+// getTitle returns the paper's title, or its name if it lacks metadata
+func getTitle(p *Paper) string {
+
+	if p.Meta.Title != "" {
+		return normalizeStr(p.Meta.Title)
+	}
+	return p.PaperName
+}
+
+// matches reports whether the listing satisfies the filters of q
+func (q *Query) matches(l *Listing) bool {
+
+	if q.allowed != nil && !q.allowed(l.Category) {
+		return false
+	}
+	if q.Category != "" && l.Category != q.Category &&
+		!strings.HasPrefix(l.Category, q.Category+"/") {
+		return false
+	}
+	if q.Journal != "" && !strings.EqualFold(q.Journal,
+		normalizeStr(l.Paper.Meta.Journal)) {
+		return false
+	}
+	if q.YearFrom != 0 || q.YearTo != 0 {
+		year := pubYear(&l.Paper.Meta)
+		if year == 0 {
+			return false
+		}
+		if (q.YearFrom != 0 && year < q.YearFrom) ||
+			(q.YearTo != 0 && year > q.YearTo) {
+			return false
+		}
+	}
+	return true
+}
+
+// less reports whether listing a sorts before b by the sort key of q; papers
+// missing the key (e.g. no journal) sort last regardless of order
+func (q *Query) less(a *Listing, b *Listing) bool {
+
+	var x, y string
+	switch q.Sort {
+	case "title":
+		x, y = strings.ToLower(getTitle(a.Paper)),
+			strings.ToLower(getTitle(b.Paper))
+	case "author":
+		x, y = strings.ToLower(getFirstAuthor(&a.Paper.Meta)),
+			strings.ToLower(getFirstAuthor(&b.Paper.Meta))
+	case "year":
+		// compared as numbers, so e.g. 999 sorts before 2020; papers
+		// without a valid year sort last
+		x, y := pubYear(&a.Paper.Meta), pubYear(&b.Paper.Meta)
+		if x != y {
+			if x == 0 || y == 0 {
+				return y == 0
+			}
+			if q.Order == "desc" {
+				return x > y
+			}
+			return x < y
+		}
+	case "journal":
+		x, y = strings.ToLower(normalizeStr(a.Paper.Meta.Journal)),
+			strings.ToLower(normalizeStr(b.Paper.Meta.Journal))
+	case "added":
+		if !a.Paper.Added.Equal(b.Paper.Added) {
+			if q.Order == "desc" {
+				return a.Paper.Added.After(b.Paper.Added)
+			}
+			return a.Paper.Added.Before(b.Paper.Added)
+		}
+	default:
+		x, y = a.Category, b.Category
+	}
+	if x != y {
+		if x == "" || y == "" {
+			return y == ""
+		}
+		if q.Order == "desc" {
+			return x > y
+		}
+		return x < y
+	}
+	return a.Key < b.Key
+}
+
+// pubYear returns the publication year of meta, or zero if it has none which
+// can be parsed
+func pubYear(meta *Meta) int {
+	year, err := strconv.Atoi(strings.TrimSpace(meta.PubYear))
+	if err != nil || year < 1 {
+		return 0
+	}
+	return year
+}
+
+// Query returns the page of listings in the papers.List set satisfying q and
+// the position of that page among all matches
+func (papers *Papers) Query(q Query) ([]Listing, Pages) {
+	papers.RLock()
+	var all []Listing
+	for category, set := range papers.List {
+		for key, paper := range set {
+			all = append(all, Listing{Key: key, Category: category,
+				Paper: paper})
+		}
+	}
+	papers.RUnlock()
+
+	// filters may consult the set themselves (e.g. category visibility), so
+	// are applied once the lock is released
+	var listings []Listing
+	for i := range all {
+		if q.matches(&all[i]) {
+			listings = append(listings, all[i])
+		}
+	}
+
+	sort.Slice(listings, func(i, j int) bool {
+		return q.less(&listings[i], &listings[j])
+	})
+
+	pages := Pages{Page: q.Page, Total: len(listings)}
+	pages.Count = (len(listings) + q.PerPage - 1) / q.PerPage
+	// an empty result has no pages, but is shown as page 1; clamping before
+	// start is computed stops a huge page overflowing it
+	if pages.Page > pages.Count {
+		pages.Page = pages.Count
+	}
+	if pages.Page < 1 {
+		pages.Page = 1
+	}
+	if pages.Page > 1 {
+		pages.Prev = pages.Page - 1
+	}
+	if pages.Page < pages.Count {
+		pages.Next = pages.Page + 1
+	}
+	start := (pages.Page - 1) * q.PerPage
+	end := start + q.PerPage
+	if end > len(listings) {
+		end = len(listings)
+	}
+	if start > end {
+		start = end
+	}
+	return listings[start:end], pages
+}
+
+// Journals returns the sorted, distinct journal names of papers in the
+// papers.List set whose categories are visible
+func (papers *Papers) Journals(visible func(string) bool) []string {
+	categories := papers.Categories(visible)
+
+	papers.RLock()
+	defer papers.RUnlock()
+	seen := make(map[string]bool)
+	var journals []string
+	for _, category := range categories {
+		for _, paper := range papers.List[category] {
+			j := normalizeStr(paper.Meta.Journal)
+			if j != "" && !seen[strings.ToLower(j)] {
+				seen[strings.ToLower(j)] = true
+				journals = append(journals, j)
+			}
+		}
+	}
+	sort.Strings(journals)
+	return journals
+}
+
+// Categories returns the sorted keys of the papers.List set whose categories
+// are visible
+func (papers *Papers) Categories(visible func(string) bool) []string {
+	papers.RLock()
+	var keys []string
+	for category := range papers.List {
+		keys = append(keys, category)
+	}
+	papers.RUnlock()
+
+	var categories []string
+	for _, category := range keys {
+		if visible(category) {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// Visible returns a copy of the papers.List set holding only the categories
+// which are visible, along with their papers
+func (papers *Papers) Visible(
+	visible func(string) bool) map[string]map[string]*Paper {
+	categories := papers.Categories(visible)
+
+	papers.RLock()
+	defer papers.RUnlock()
+	list := make(map[string]map[string]*Paper)
+	for _, category := range categories {
+		set, exists := papers.List[category]
+		if exists == false {
+			continue
+		}
+		list[category] = make(map[string]*Paper)
+		for key, paper := range set {
+			list[category][key] = paper
+		}
+	}
+	return list
+}
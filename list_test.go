@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryPageOverflow(t *testing.T) {
+	var papers Papers
+	papers.List = map[string]map[string]*Paper{
+		"empty": make(map[string]*Paper),
+	}
+	r := httptest.NewRequest(http.MethodGet,
+		"/?page=9223372036854775807&category=empty", nil)
+	q := parseQuery(r)
+
+	listings, pages := papers.Query(q)
+	if len(listings) != 0 {
+		t.Fatalf("%d listings, want none", len(listings))
+	}
+	if pages.Page != 1 || pages.Count != 0 {
+		t.Fatalf("page %d of %d, want page 1 of 0", pages.Page, pages.Count)
+	}
+	if pages.Prev != 0 || pages.Next != 0 {
+		t.Fatalf("prev %d, next %d, want neither", pages.Prev, pages.Next)
+	}
+}
+
+func TestQuerySortYear(t *testing.T) {
+	var papers Papers
+	papers.List = map[string]map[string]*Paper{"Maths": {}}
+	for name, year := range map[string]string{
+		"a": "2020", "b": "999", "c": "", "d": "n.d.", "e": "1987",
+	} {
+		papers.List["Maths"]["Maths/"+name+".pdf"] = &Paper{PaperName: name,
+			Meta: Meta{PubYear: year}}
+	}
+
+	for _, tt := range []struct {
+		order string
+		want  string
+	}{
+		{"asc", "beacd"},
+		{"desc", "aebcd"},
+	} {
+		r := httptest.NewRequest(http.MethodGet,
+			"/?sort=year&order="+tt.order, nil)
+		listings, _ := papers.Query(parseQuery(r))
+		var got string
+		for _, l := range listings {
+			got += l.Paper.PaperName
+		}
+		if got != tt.want {
+			t.Errorf("sorted by year %s: %q, want %q", tt.order, got,
+				tt.want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// ARTICLE_TYPES are the schema.org types of the JSON-LD node describing a
+// landing page's paper, by preference
+var ARTICLE_TYPES = []string{"ScholarlyArticle", "MedicalScholarlyArticle",
+	"Article", "Report", "Thesis", "Chapter"}
+
+// getMetaFromPage returns the metadata of a landing page, merged from its
+// sources by precedence: Highwire citation_* tags, then schema.org JSON-LD,
+// then Dublin Core. Each field is taken from the first source providing it,
+// and the authors and publication date from the first source with any
+func getMetaFromPage(doc *html.Node) *Meta {
+
+	meta := getMetaFromCitation(doc)
+	mergeMeta(meta, getMetaFromJSONLD(doc))
+	mergeMeta(meta, getMetaFromDublinCore(doc))
+	return meta
+}
+
+// mergeMeta sets the fields of dst which are empty to those of src
+func mergeMeta(dst *Meta, src *Meta) {
+	for _, f := range []struct{ dst, src *string }{
+		{&dst.Journal, &src.Journal},
+		{&dst.ISSN, &src.ISSN},
+		{&dst.Title, &src.Title},
+		{&dst.FirstPage, &src.FirstPage},
+		{&dst.LastPage, &src.LastPage},
+		{&dst.DOI, &src.DOI},
+		{&dst.ArxivID, &src.ArxivID},
+		{&dst.Resource, &src.Resource},
+	} {
+		if *f.dst == "" {
+			*f.dst = strings.TrimSpace(*f.src)
+		}
+	}
+	if len(dst.Contributors) == 0 {
+		dst.Contributors = src.Contributors
+	}
+	// the year and month of one source aren't mixed with those of another
+	if dst.PubYear == "" {
+		dst.PubYear, dst.PubMonth = src.PubYear, src.PubMonth
+	}
+}
+
+// parseName returns the author named s, e.g. "Doe, Jain" or "Jain Doe"
+func parseName(s string) Contributor {
+	var c Contributor
+	s = strings.TrimSpace(s)
+	// Doe, Jain
+	if strings.Contains(s, ",") {
+		v := strings.Split(s, ",")
+		c.FirstName = strings.TrimSpace(strings.Join(v[1:], " "))
+		c.LastName = strings.TrimSpace(v[0])
+		// Jain Doe
+	} else {
+		v := strings.Fields(s)
+		if len(v) > 0 {
+			c.FirstName = strings.Join(v[:len(v)-1], " ")
+			c.LastName = v[len(v)-1]
+		}
+	}
+	return c
+}
+
+// addAuthor appends c to the contributors of meta as an author
+func addAuthor(meta *Meta, c Contributor) {
+	if c.FirstName == "" && c.LastName == "" {
+		return
+	}
+	c.Role = "author"
+	if len(meta.Contributors) > 0 {
+		c.Sequence = "additional"
+	} else {
+		c.Sequence = "first"
+	}
+	meta.Contributors = append(meta.Contributors, c)
+}
+
+// setPubDate sets the publication year, and the month if known, of meta from
+// s, e.g. 2020-05-01, 2020/05, 2020 or 2020-05-01T12:00:00Z; it reports
+// whether s could be parsed
+func setPubDate(meta *Meta, s string) bool {
+	s = strings.TrimSpace(s)
+	if len(s) > 10 && (s[10] == 'T' || s[10] == ' ') {
+		s = s[:10]
+	}
+	for _, format := range []string{"2006-01-02", "2006/01/02", "2006-01",
+		"2006/01", "2006"} {
+		t, err := time.Parse(format, s)
+		if err != nil {
+			continue
+		}
+		meta.PubYear = strconv.Itoa(t.Year())
+		if format != "2006" {
+			meta.PubMonth = t.Month().String()
+		}
+		return true
+	}
+	return false
+}
+
+// getMetaFromDublinCore parses a landing page for Dublin Core <meta> tags
+// (DC.* and DCTERMS.*, of any case) to populate a paper's Meta attributes
+func getMetaFromDublinCore(doc *html.Node) *Meta {
+
+	var meta Meta
+	var issued, date, publisher string
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "meta" {
+			name := attr(n, "name")
+			if name == "" {
+				name = attr(n, "property")
+			}
+			cont := strings.TrimSpace(attr(n, "content"))
+			switch strings.ToLower(name) {
+			case "dc.title", "dcterms.title":
+				if meta.Title == "" {
+					meta.Title = cont
+				}
+			case "dc.creator", "dcterms.creator":
+				addAuthor(&meta, parseName(cont))
+			case "dcterms.issued", "dc.date.issued":
+				if issued == "" {
+					issued = cont
+				}
+			case "dc.date", "dcterms.date", "dcterms.created":
+				if date == "" {
+					date = cont
+				}
+			case "dc.source", "dcterms.ispartof", "dc.relation.ispartof":
+				if meta.Journal == "" && !strings.HasPrefix(cont, "http") {
+					meta.Journal = cont
+				}
+			case "dc.publisher", "dcterms.publisher":
+				if publisher == "" {
+					publisher = cont
+				}
+			case "dc.source.issn":
+				if meta.ISSN == "" {
+					meta.ISSN = cont
+				}
+			case "dc.identifier", "dcterms.identifier", "dc.identifier.doi":
+				if doi := getDOIFromBytes([]byte(cont)); meta.DOI == "" &&
+					doi != nil {
+					meta.DOI = string(doi)
+				}
+			case "dc.identifier.pagenumber":
+				// e.g. 12-34, as published by Open Journal Systems
+				v := strings.SplitN(cont, "-", 2)
+				meta.FirstPage = strings.TrimSpace(v[0])
+				if len(v) == 2 {
+					meta.LastPage = strings.TrimSpace(v[1])
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	// the date of issue is preferred to a date of unspecified meaning, and
+	// the journal to the publisher
+	if setPubDate(&meta, issued) == false {
+		setPubDate(&meta, date)
+	}
+	if meta.Journal == "" {
+		meta.Journal = publisher
+	}
+	return &meta
+}
+
+// getMetaFromJSONLD parses a landing page for a schema.org ScholarlyArticle,
+// or similar, in a <script type="application/ld+json"> to populate a paper's
+// Meta attributes
+func getMetaFromJSONLD(doc *html.Node) *Meta {
+
+	var nodes []map[string]interface{}
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "script" &&
+			strings.EqualFold(strings.TrimSpace(attr(n, "type")),
+				"application/ld+json") {
+			var v interface{}
+			if err := json.Unmarshal([]byte(text(n)), &v); err == nil {
+				nodes = append(nodes, ldNodes(v)...)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	var meta Meta
+	article := ldArticle(nodes)
+	if article == nil {
+		return &meta
+	}
+	meta.Title = ldString(article["name"])
+	if meta.Title == "" {
+		meta.Title = ldString(article["headline"])
+	}
+	authors := article["author"]
+	if authors == nil {
+		authors = article["creator"]
+	}
+	for _, a := range ldList(authors) {
+		switch a := a.(type) {
+		case string:
+			addAuthor(&meta, parseName(a))
+		case map[string]interface{}:
+			c := Contributor{
+				FirstName: ldString(a["givenName"]),
+				LastName:  ldString(a["familyName"]),
+			}
+			if c.FirstName == "" && c.LastName == "" {
+				c = parseName(ldString(a["name"]))
+			}
+			addAuthor(&meta, c)
+		}
+	}
+	setPubDate(&meta, ldString(article["datePublished"]))
+	meta.FirstPage = ldString(article["pageStart"])
+	meta.LastPage = ldString(article["pageEnd"])
+
+	// the journal is the Periodical the article is part of, perhaps through
+	// its PublicationIssue and PublicationVolume
+	for part := article["isPartOf"]; part != nil; {
+		p, ok := ldList(part)[0].(map[string]interface{})
+		if ok == false {
+			break
+		}
+		if ldIsType(p, "Periodical") {
+			meta.Journal = ldString(p["name"])
+			meta.ISSN = ldString(p["issn"])
+			break
+		}
+		part = p["isPartOf"]
+	}
+
+	// an identifier declared a DOI is preferred to any DOI found in the others
+	for _, id := range ldList(article["identifier"]) {
+		p, ok := id.(map[string]interface{})
+		if ok && strings.EqualFold(ldString(p["propertyID"]), "doi") {
+			doi := getDOIFromBytes([]byte(ldString(p["value"])))
+			if doi != nil {
+				meta.DOI = string(doi)
+				break
+			}
+		}
+	}
+	for _, key := range []string{"identifier", "sameAs", "@id", "url"} {
+		if meta.DOI != "" {
+			break
+		}
+		for _, s := range ldStrings(article[key]) {
+			if doi := getDOIFromBytes([]byte(s)); doi != nil {
+				meta.DOI = string(doi)
+				break
+			}
+		}
+	}
+	return &meta
+}
+
+// ldNodes returns the JSON-LD nodes of v: the objects of an array, or of an
+// object's @graph, along with the object itself
+func ldNodes(v interface{}) []map[string]interface{} {
+	var nodes []map[string]interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			nodes = append(nodes, ldNodes(e)...)
+		}
+	case map[string]interface{}:
+		nodes = append(nodes, v)
+		if graph, exists := v["@graph"]; exists {
+			nodes = append(nodes, ldNodes(graph)...)
+		}
+	}
+	return nodes
+}
+
+// ldArticle returns the node describing the paper, of the most preferred of
+// ARTICLE_TYPES, or nil if there is none
+func ldArticle(nodes []map[string]interface{}) map[string]interface{} {
+	for _, t := range ARTICLE_TYPES {
+		for _, n := range nodes {
+			if ldIsType(n, t) {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// ldIsType reports whether node has the schema.org type t, one of possibly
+// several, e.g. "ScholarlyArticle" or "https://schema.org/ScholarlyArticle"
+func ldIsType(node map[string]interface{}, t string) bool {
+	for _, s := range ldStrings(node["@type"]) {
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "http://schema.org/"),
+			"https://schema.org/")
+		if strings.TrimPrefix(s, "schema:") == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ldList returns v, a value which may be given once or as an array, as an
+// array of at least one element
+func ldList(v interface{}) []interface{} {
+	if a, ok := v.([]interface{}); ok && len(a) > 0 {
+		return a
+	}
+	return []interface{}{v}
+}
+
+// ldString returns the text of v: a string, a number, the @value or name of an
+// object, or the first of an array of these; empty if there is none
+func ldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}:
+		for _, key := range []string{"@value", "name", "value"} {
+			if s := ldString(v[key]); s != "" {
+				return s
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if s := ldString(e); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// ldStrings returns every string within v, e.g. the values of an array of
+// PropertyValue identifiers; those of an object are in a fixed order, its
+// value first and then by key, so the first DOI found is always the same
+func ldStrings(v interface{}) []string {
+	var strs []string
+	switch v := v.(type) {
+	case string:
+		strs = append(strs, v)
+	case map[string]interface{}:
+		keys := []string{"@value", "value"}
+		var rest []string
+		for key := range v {
+			if key != "@value" && key != "value" {
+				rest = append(rest, key)
+			}
+		}
+		sort.Strings(rest)
+		for _, key := range append(keys, rest...) {
+			strs = append(strs, ldStrings(v[key])...)
+		}
+	case []interface{}:
+		for _, e := range v {
+			strs = append(strs, ldStrings(e)...)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaults of the outbound request settings; the interval and backoff are in
+// milliseconds
+const (
+	HOST_CONCURRENCY = 2      // requests in flight to a single host
+	HOST_INTERVAL    = 500    // between the start of requests to a single host
+	RETRIES          = 3      // further attempts at a request which may succeed
+	BACKOFF          = 1000   // before the first retry, doubling with each
+	MAX_BACKOFF      = 120000 // longest wait before a retry, incl. Retry-After
+)
+
+// outbound is the transport of the outbound client, shared by every request
+var outbound *Outbound
+
+// errBlocked is returned when dialing an address crane may not connect to
+var errBlocked = errors.New("requests to private IPs are blocked")
+
+// Outbound is the http.RoundTripper of the outbound client: requests are
+// limited per host, in the number made concurrently and how often they
+// start, and retried with exponential backoff if they fail in a way which may
+// not recur, e.g. with status 429 or 503, honoring Retry-After
+type Outbound struct {
+	Transport   http.RoundTripper
+	Concurrency int
+	Interval    time.Duration
+	Retries     int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+// hostLimit is the state of the limits applied to requests to a single host
+type hostLimit struct {
+	sem  chan struct{} // a slot is held until the response body is closed
+	next time.Time     // before which no further request may start
+}
+
+// NewOutbound returns an Outbound using the default settings
+func NewOutbound(transport http.RoundTripper) *Outbound {
+	return &Outbound{
+		Transport:   transport,
+		Concurrency: HOST_CONCURRENCY,
+		Interval:    HOST_INTERVAL * time.Millisecond,
+		Retries:     RETRIES,
+		Backoff:     BACKOFF * time.Millisecond,
+		MaxBackoff:  MAX_BACKOFF * time.Millisecond,
+		hosts:       make(map[string]*hostLimit),
+	}
+}
+
+// host returns the limits of the named host, creating them on first use
+func (o *Outbound) host(name string) *hostLimit {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h, exists := o.hosts[name]
+	if exists == false {
+		n := o.Concurrency
+		if n < 1 {
+			n = 1
+		}
+		h = &hostLimit{sem: make(chan struct{}, n)}
+		o.hosts[name] = h
+	}
+	return h
+}
+
+// delay postpones the start of further requests to the host until at least
+// wait from now, e.g. when asked to by Retry-After
+func (o *Outbound) delay(h *hostLimit, wait time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if t := time.Now().Add(wait); t.After(h.next) {
+		h.next = t
+	}
+}
+
+// acquire waits for a free slot and the host's turn to start a request
+func (o *Outbound) acquire(ctx context.Context, h *hostLimit) error {
+	select {
+	case h.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	o.mu.Lock()
+	now := time.Now()
+	start := h.next
+	if start.Before(now) {
+		start = now
+	}
+	h.next = start.Add(o.Interval)
+	o.mu.Unlock()
+	if err := sleep(ctx, start.Sub(now)); err != nil {
+		<-h.sem
+		return err
+	}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (o *Outbound) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := o.host(req.URL.Hostname())
+	idempotent := req.Method == "GET" || req.Method == "HEAD"
+
+	for attempt := 0; ; attempt++ {
+		if err := o.acquire(req.Context(), h); err != nil {
+			return nil, err
+		}
+		resp, err := o.Transport.RoundTrip(req)
+		if err == nil {
+			resp.Body = &releaseBody{ReadCloser: resp.Body, sem: h.sem}
+		} else {
+			<-h.sem
+		}
+
+		retry, wait := o.classify(resp, err, attempt)
+		if retry == false || idempotent == false || attempt >= o.Retries {
+			return resp, err
+		}
+		if wait > o.MaxBackoff {
+			// the server asked us to wait longer than we're willing to
+			return resp, err
+		}
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			o.delay(h, wait)
+		}
+		log.Printf("%s: %s, retrying in %v", req.URL.String(), reason, wait)
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// classify reports whether a request which got resp or err may succeed if
+// retried, and how long to wait before doing so
+func (o *Outbound) classify(resp *http.Response, err error,
+	attempt int) (bool, time.Duration) {
+
+	backoff := o.Backoff << uint(attempt)
+	if backoff <= 0 || backoff > o.MaxBackoff {
+		backoff = o.MaxBackoff
+	}
+	// jitter, so requests which failed together aren't retried together
+	backoff += time.Duration(rand.Int63n(int64(backoff)/4 + 1))
+
+	if err != nil {
+		return retryable(err), backoff
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return true, wait
+		}
+		return true, backoff
+	case http.StatusRequestTimeout, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true, backoff
+	}
+	return false, 0
+}
+
+// retryable reports whether a request which failed with err may succeed if
+// retried, e.g. after a reset connection or a timeout, but not an unknown
+// host, a blocked address or an invalid certificate
+func retryable(err error) bool {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, errBlocked):
+		return false
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsNotFound == false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryAfter parses the value of a Retry-After header, either a number of
+// seconds or an HTTP date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseBody frees the request's slot of its host once the body is closed
+type releaseBody struct {
+	io.ReadCloser
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { <-b.sem })
+	return err
+}
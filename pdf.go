@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// PDF_HEAD and PDF_TAIL are the number of bytes at the start and end of a file
+// searched for the PDF header and trailer; both may be offset by junk bytes
+const (
+	PDF_HEAD = 1024
+	PDF_TAIL = 4096
+)
+
+// checkPDFHeader returns an error describing the content of b, the start of a
+// file, if it isn't a PDF; the header may be preceded by up to PDF_HEAD bytes
+func checkPDFHeader(b []byte) error {
+	if len(b) > PDF_HEAD {
+		b = b[:PDF_HEAD]
+	}
+	if bytes.Contains(b, []byte("%PDF-")) {
+		return nil
+	}
+	lower := bytes.ToLower(bytes.TrimSpace(b))
+	if bytes.HasPrefix(lower, []byte("<")) &&
+		(bytes.Contains(lower, []byte("<html")) ||
+			bytes.Contains(lower, []byte("<!doctype html"))) {
+		return errors.New("HTML page, not a PDF")
+	}
+	return errors.New("not a PDF (missing %PDF- header)")
+}
+
+// checkPDFTrailer returns an error if b, the end of a file, lacks the %%EOF
+// marker and the startxref offset preceding it, as when a download is cut
+// short; incrementally updated PDFs have several, so the last is checked
+func checkPDFTrailer(b []byte) error {
+	eof := bytes.LastIndex(b, []byte("%%EOF"))
+	if eof == -1 {
+		return errors.New("truncated PDF (no %%EOF marker)")
+	}
+	if bytes.LastIndex(b[:eof], []byte("startxref")) == -1 {
+		return errors.New("truncated PDF (no startxref before %%EOF)")
+	}
+	return nil
+}
+
+// readTail returns up to the last n bytes of the file at path
+func readTail(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > n {
+		if _, err := f.Seek(info.Size()-n, 0); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// validatePDF returns an error if the file at path isn't a complete PDF,
+// e.g. an HTML paywall or captcha page served as application/pdf, or a body
+// cut short
+func validatePDF(path string) error {
+	head, err := readHead(path, PDF_HEAD)
+	if err != nil {
+		return err
+	}
+	if len(head) == 0 {
+		return errors.New("empty file, not a PDF")
+	}
+	if err := checkPDFHeader(head); err != nil {
+		return err
+	}
+	tail, err := readTail(path, PDF_TAIL)
+	if err != nil {
+		return err
+	}
+	return checkPDFTrailer(tail)
+}
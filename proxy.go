@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseBasePath normalizes the path crane is mounted at, e.g. "library/" to
+// "/library"; the root is the empty string
+func parseBasePath(s string) (string, error) {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return "", nil
+	}
+	for _, v := range strings.Split(s, "/") {
+		if v == "" || v == "." || v == ".." {
+			return "", fmt.Errorf("base path %q is not a clean path", s)
+		}
+	}
+	if strings.ContainsAny(s, "?#\"'<> ") {
+		return "", fmt.Errorf("base path %q contains invalid characters", s)
+	}
+	return "/" + s, nil
+}
+
+// base returns the path crane is mounted at, for use in templates; every
+// absolute link is prefixed with it
+func base() string {
+	return basePath
+}
+
+// redirect replies to the request with a redirect to path, which is relative
+// to the base path
+func redirect(w http.ResponseWriter, r *http.Request, path string, code int) {
+	http.Redirect(w, r, basePath+path, code)
+}
+
+// parseIPNets parses a comma-separated list of IP addresses and CIDR
+// ranges, e.g. 127.0.0.1,10.0.0.0/8
+func parseIPNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range splitList(s) {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip,
+				Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseTrustedProxies parses the -trusted-proxies list: IP addresses and CIDR
+// ranges, and "unix" to trust every peer of the Unix domain socket
+func parseTrustedProxies(s string) ([]*net.IPNet, bool, error) {
+	var addrs []string
+	var socket bool
+	for _, v := range splitList(s) {
+		if strings.TrimSpace(v) == "unix" {
+			socket = true
+		} else {
+			addrs = append(addrs, v)
+		}
+	}
+	nets, err := parseIPNets(strings.Join(addrs, ","))
+	return nets, socket, err
+}
+
+// trusted reports whether the host of a request's RemoteAddr is one of the
+// trusted proxies; connections over a Unix domain socket, which have no
+// address, are trusted only if trustSocket is set
+func trusted(remoteAddr string) bool {
+	h, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		h = remoteAddr
+	}
+	if h == "" || h == "@" {
+		return trustSocket
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the IP address of the client making the request, as
+// reported by trusted proxies if forwarded by one
+func clientAddr(r *http.Request) string {
+	h, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return h
+}
+
+// isHTTPS reports whether the client made the request over HTTPS, either
+// directly or by way of a trusted proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
+
+// forwarded applies the X-Forwarded-For and -Proto headers of requests made by
+// trusted proxies to the request's RemoteAddr and URL.Scheme; the headers of
+// other clients are ignored, as they can be forged. X-Forwarded-Host isn't
+// needed, as redirects are to paths, which clients resolve against the host
+// they requested
+func forwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if trusted(r.RemoteAddr) {
+
+			// each proxy appends the address it received the request from, so
+			// the client is the rightmost address which isn't a trusted proxy
+			var hops []string
+			for _, h := range r.Header["X-Forwarded-For"] {
+				hops = append(hops, strings.Split(h, ",")...)
+			}
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				if net.ParseIP(hop) == nil {
+					break
+				}
+				r.RemoteAddr = net.JoinHostPort(hop, "0")
+				if !trusted(r.RemoteAddr) {
+					break
+				}
+			}
+			switch strings.ToLower(r.Header.Get("X-Forwarded-Proto")) {
+			case "https":
+				r.URL.Scheme = "https"
+			case "http":
+				r.URL.Scheme = "http"
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mount serves next beneath the base path, stripping it from request paths;
+// requests outside of it are not found
+func mount(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	strip := http.StripPrefix(basePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.Error(w, http.StatusText(http.StatusNotFound),
+				http.StatusNotFound)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
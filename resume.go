@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// STAGING_DIR is the hidden directory of papers.Path in which interrupted
+// downloads are kept so they may be resumed; those left for PARTIAL_EXPIRY
+// are removed when the library is opened
+const (
+	STAGING_DIR    = ".partial"
+	PARTIAL_EXPIRY = 7 * 24 * time.Hour
+)
+
+// stagingDir is the STAGING_DIR of the open library; downloads made without
+// one (e.g. by verify) can't be resumed
+var stagingDir string
+
+// claimPartial reserves the staged file at path for a download by creating
+// its lockfile exclusively, reporting false if another download has it, in
+// this process or another (e.g. the server and crane add), so they don't
+// append to the same file; the lockfile holds its owner's PID, and is replaced
+// once the owner has exited. An empty path is always claimed
+func claimPartial(path string) bool {
+	if path == "" {
+		return true
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return false
+	}
+	lock := path + ".lock"
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				os.Remove(lock)
+				return false
+			}
+			return true
+		}
+		if os.IsExist(err) == false || lockHeld(lock) {
+			return false
+		}
+		os.Remove(lock)
+	}
+	return false
+}
+
+// lockHeld reports whether the process which created the lockfile at path is
+// still running; a lockfile without a PID is held for a minute, as its owner
+// may not have written it yet
+func lockHeld(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return true
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Since(info.ModTime()) < time.Minute
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// processes which no longer exist can't be found on Windows, and can't
+	// be signalled elsewhere
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// releasePartial releases the staged file at path once its download is done
+func releasePartial(path string) {
+	if path == "" {
+		return
+	}
+	os.Remove(path + ".lock")
+}
+
+// Partial is a download staged in stagingDir, along with the validators of
+// the response it came from, which a later attempt must match to resume it
+type Partial struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	path   string // of the staged bytes; the validators are at path+".json"
+	ranges bool   // whether the server accepts byte range requests
+	ctx    context.Context
+}
+
+// newPartial returns the Partial of the file served by resp; its path is
+// derived from the URL, so a retried job finds the bytes of an earlier one
+func newPartial(resp *http.Response) *Partial {
+	p := &Partial{
+		URL:          resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ranges:       resp.Header.Get("Accept-Ranges") == "bytes",
+		ctx:          resp.Request.Context(),
+	}
+	if stagingDir != "" {
+		sum := sha256.Sum256([]byte(p.URL))
+		p.path = filepath.Join(stagingDir, hex.EncodeToString(sum[:16])+
+			".part")
+	}
+	return p
+}
+
+// Restart updates the validators of the download from resp, the whole file
+// served in place of the rest of it; the URL and claimed path are kept, even
+// if resp was redirected elsewhere, so the bytes are still staged where this
+// download holds the lock, and found by a retry of the same URL
+func (p *Partial) Restart(resp *http.Response) {
+	p.ETag = resp.Header.Get("ETag")
+	p.LastModified = resp.Header.Get("Last-Modified")
+	p.ranges = resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// validator returns the value of the If-Range header of a request resuming
+// the download; weak ETags can't be used, as they may match a different
+// sequence of bytes
+func (p *Partial) validator() string {
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// Resumable reports whether the download can be staged and later resumed
+func (p *Partial) Resumable() bool {
+	return p.path != "" && p.ranges && p.validator() != ""
+}
+
+// Offset returns the number of bytes already staged for the download, or
+// zero if there are none, or they came from a different version of the file
+func (p *Partial) Offset() int64 {
+	if p.Resumable() == false {
+		return 0
+	}
+	var staged Partial
+	b, err := ioutil.ReadFile(p.path + ".json")
+	if err == nil {
+		err = json.Unmarshal(b, &staged)
+	}
+	if err != nil || staged.URL != p.URL || staged.ETag != p.ETag ||
+		staged.LastModified != p.LastModified {
+		p.Discard()
+		return 0
+	}
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Resume requests the rest of the file from offset; the response is the
+// whole file (status 200) if it has changed since the bytes were staged
+func (p *Partial) Resume(offset int64) (*http.Response, error) {
+	req, err := newRequest(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", p.validator())
+
+	// made for the same resolver, and through the same proxy, as the original
+	resp, err := client.Do(req.WithContext(p.ctx))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		p.Discard()
+		return resp, nil
+	case resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"),
+			fmt.Sprintf("bytes %d-", offset)):
+		return resp, nil
+	}
+	resp.Body.Close()
+	p.Discard()
+	return nil, fmt.Errorf("%q: resuming download: %s", p.URL, resp.Status)
+}
+
+// Stage creates the staged file, truncating it unless appending from offset;
+// a file which is started afresh has its old validators removed first, and
+// the new ones are only recorded by Record once bytes have been written, so
+// the bytes of one version of a file are never matched to another's
+func (p *Partial) Stage(offset int64) (*os.File, error) {
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		if err := os.Remove(p.path + ".json"); err != nil &&
+			os.IsNotExist(err) == false {
+			return nil, err
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	return os.OpenFile(p.path, flags, 0644)
+}
+
+// Record writes the validators of the download alongside its staged bytes,
+// by way of a temporary file so they're never left partly written
+func (p *Partial) Record() error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(stagingDir, ".tmp-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path+".json")
+}
+
+// Discard removes the staged file and its validators
+func (p *Partial) Discard() {
+	if p.path == "" {
+		return
+	}
+	os.Remove(p.path)
+	os.Remove(p.path + ".json")
+}
+
+// cleanPartials removes downloads staged more than PARTIAL_EXPIRY ago, along
+// with lockfiles and validators left behind
+func cleanPartials() {
+	files, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > PARTIAL_EXPIRY {
+			os.Remove(filepath.Join(stagingDir, f.Name()))
+		}
+	}
+}
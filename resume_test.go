@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestClaimPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-partial-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.part")
+
+	if claimPartial(path) == false {
+		t.Fatal("unclaimed path not claimed")
+	}
+	if claimPartial(path) {
+		t.Fatal("claimed path claimed again")
+	}
+	releasePartial(path)
+	if claimPartial(path) == false {
+		t.Fatal("released path not claimed")
+	}
+	releasePartial(path)
+
+	// a lockfile whose owner has exited is replaced; PIDs are well below
+	// this on every system tested
+	err = ioutil.WriteFile(path+".lock", []byte(strconv.Itoa(1<<30)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimPartial(path) == false {
+		t.Fatal("path with stale lockfile not claimed")
+	}
+	releasePartial(path)
+
+	// a lockfile without a PID may be being written by its owner
+	if err := ioutil.WriteFile(path+".lock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if claimPartial(path) {
+		t.Fatal("path with new, empty lockfile claimed")
+	}
+
+	if claimPartial("") == false {
+		t.Fatal("empty path not claimed")
+	}
+}
+
+func TestStageRecordsValidatorsLast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-partial-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s string) { stagingDir = s }(stagingDir)
+	stagingDir = dir
+
+	p := &Partial{URL: "https://example.org/a.pdf", ETag: `"v1"`,
+		path: filepath.Join(dir, "a.part"), ranges: true}
+	if err := ioutil.WriteFile(p.path+".json",
+		[]byte(`{"url":"https://example.org/a.pdf","etag":"\"v0\""}`),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the validators of the previous version are gone once it's restaged,
+	// so its bytes can't be resumed as the new one's
+	f, err := p.Stage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := os.Stat(p.path + ".json"); os.IsNotExist(err) == false {
+		t.Fatalf("validators left in place when staging afresh: %v", err)
+	}
+	if _, err := f.WriteString("%PDF-1.4\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Record(); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Offset(); n != int64(len("%PDF-1.4\n")) {
+		t.Fatalf("Offset() = %d after recording, want %d", n,
+			len("%PDF-1.4\n"))
+	}
+}
+
+func TestRestartKeepsClaimedPath(t *testing.T) {
+	p := &Partial{URL: "https://example.org/a.pdf", ETag: `"v1"`,
+		path: "/staging/a.part", ranges: true}
+
+	// the resumed request was redirected and served the whole file afresh
+	resp := &http.Response{
+		Request: httptest.NewRequest(http.MethodGet,
+			"https://mirror.example.org/a.pdf", nil),
+		Header: http.Header{"Etag": {`"v2"`}},
+	}
+	p.Restart(resp)
+	if p.path != "/staging/a.part" || p.URL != "https://example.org/a.pdf" {
+		t.Fatalf("restarted as %q at %q, want the claimed path kept", p.URL,
+			p.path)
+	}
+	if p.ETag != `"v2"` || p.ranges {
+		t.Fatalf("validators not updated: ETag %q, ranges %v", p.ETag,
+			p.ranges)
+	}
+}
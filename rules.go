@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// kinds of Rule locating the PDF of a landing page
+const (
+	RULE_REWRITE = "rewrite" // rewrite REGEX REPLACEMENT, applied to the page's URL
+	RULE_LINK    = "link"    // link REGEX, matching the URL of an <a>
+	RULE_TEXT    = "text"    // text REGEX, matching the text of an <a>
+	RULE_SRC     = "src"     // src TAG [REGEX], the source of e.g. an <iframe>
+)
+
+// MAX_RULE_LINKS is the number of links found by rules which are tried
+const MAX_RULE_LINKS = 3
+
+// Rule locates the PDF of a publisher's landing page which lacks a
+// citation_pdf_url <meta> tag
+type Rule struct {
+	Domain  string // of the page and its subdomains; any if empty
+	Kind    string
+	Pattern *regexp.Regexp // optional for RULE_SRC
+	Arg     string         // replacement of RULE_REWRITE, tag of RULE_SRC
+}
+
+// builtinRules cover the patterns common to many publishers; rules read from
+// the -rules directory are tried before them
+var builtinRules = []Rule{
+	newRule("onlinelibrary.wiley.com", RULE_REWRITE,
+		`^(https?://[^/]+)/doi/(?:abs|full|epdf|pdf)/(.+)$`,
+		"$1/doi/pdfdirect/$2"),
+
+	// Atypon-hosted journals, e.g. tandfonline, sagepub, pubs.acs.org
+	newRule("", RULE_REWRITE, `^(https?://[^/]+)/doi/(?:abs|full|epdf)/(.+)$`,
+		"$1/doi/pdf/$2"),
+	newRule("", RULE_SRC, `(?i)pdf`, "iframe"),
+	newRule("", RULE_SRC, `(?i)pdf`, "embed"),
+	newRule("", RULE_TEXT,
+		`(?i)^\s*(download\s+(the\s+)?(article\s+)?pdf|(view\s+)?pdf|full[\s-]text\s+pdf)\s*$`,
+		""),
+	newRule("", RULE_LINK, `(?i)\.pdf([?#].*)?$`, ""),
+}
+
+var rules []Rule // read from the -rules directory
+
+// newRule returns a rule whose pattern is known to compile
+func newRule(domain, kind, pattern, arg string) Rule {
+	return Rule{domain, kind, regexp.MustCompile(pattern), arg}
+}
+
+// parseRule parses a line of a rule file: a kind followed by its
+// whitespace-separated arguments, e.g. rewrite ^(.*)/abs/(.*)$ $1/pdf/$2
+func parseRule(domain string, line string) (Rule, error) {
+	v := strings.Fields(line)
+	r := Rule{Domain: domain, Kind: v[0]}
+	var pattern string
+	switch {
+	case r.Kind == RULE_REWRITE && len(v) == 3:
+		pattern, r.Arg = v[1], v[2]
+	case (r.Kind == RULE_LINK || r.Kind == RULE_TEXT) && len(v) == 2:
+		pattern = v[1]
+	case r.Kind == RULE_SRC && (len(v) == 2 || len(v) == 3):
+		r.Arg = strings.ToLower(v[1])
+		if len(v) == 3 {
+			pattern = v[2]
+		}
+	default:
+		return r, fmt.Errorf("expected rewrite REGEX REPLACEMENT, link REGEX, " +
+			"text REGEX or src TAG [REGEX]")
+	}
+	if pattern != "" {
+		var err error
+		if r.Pattern, err = regexp.Compile(pattern); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// loadRules reads the rule files of dir, each named after the domain whose
+// landing pages it applies to (and those of its subdomains), e.g.
+// example.org.rules; a file named default.rules applies to every domain
+func loadRules(dir string) ([]Rule, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []Rule
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".rules" {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSuffix(f.Name(), ".rules"))
+		if domain == "default" {
+			domain = ""
+		}
+		path := filepath.Join(dir, f.Name())
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(file)
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := parseRule(domain, line)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			loaded = append(loaded, r)
+		}
+		file.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// matches reports whether the rule applies to pages of host
+func (r Rule) matches(host string) bool {
+	return r.Domain == "" || host == r.Domain ||
+		strings.HasSuffix(host, "."+r.Domain)
+}
+
+// apply returns the links the rule finds in doc, the landing page at base
+func (r Rule) apply(doc *html.Node, base *url.URL) []string {
+	var links []string
+	if r.Kind == RULE_REWRITE {
+		if u := base.String(); r.Pattern.MatchString(u) {
+			links = append(links, r.Pattern.ReplaceAllString(u, r.Arg))
+		}
+		return links
+	}
+
+	resolve := func(ref string) string {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return ""
+		}
+		u.Fragment = ""
+		return u.String()
+	}
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch {
+			case r.Kind == RULE_SRC && n.Data == r.Arg:
+				link := resolve(attr(n, "src"))
+				if link != "" && (r.Pattern == nil ||
+					r.Pattern.MatchString(link)) {
+					links = append(links, link)
+				}
+			case r.Kind == RULE_LINK && n.Data == "a":
+				link := resolve(attr(n, "href"))
+				if link != "" && r.Pattern.MatchString(link) {
+					links = append(links, link)
+				}
+			case r.Kind == RULE_TEXT && n.Data == "a":
+				link := resolve(attr(n, "href"))
+				if link != "" && r.Pattern.MatchString(text(n)) {
+					links = append(links, link)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	return links
+}
+
+// attr returns the value of the named attribute of n
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// text returns the text content of n and its descendants
+func text(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(text(c))
+	}
+	return b.String()
+}
+
+// findPDFLinks returns the links to the PDF of doc, the landing page at base,
+// found by the rules applying to its domain, user rules first; at most
+// MAX_RULE_LINKS are returned
+func findPDFLinks(doc *html.Node, base *url.URL) []string {
+	host := strings.ToLower(base.Hostname())
+	seen := map[string]bool{base.String(): true}
+	var links []string
+	for _, r := range append(append([]Rule{}, rules...), builtinRules...) {
+		if r.matches(host) == false {
+			continue
+		}
+		for _, link := range r.apply(doc, base) {
+			if seen[link] {
+				continue
+			}
+			seen[link] = true
+			if links = append(links, link); len(links) == MAX_RULE_LINKS {
+				return links
+			}
+		}
+	}
+	return links
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CERT_CHECK is how often the TLS certificate and key files are checked for
+// changes, at most, while handshakes are taking place
+const CERT_CHECK time.Duration = 10 * time.Second
+
+// Listener describes where and how crane serves HTTP: on host:port or a Unix
+// domain socket, in plain text or TLS, optionally redirecting plain HTTP
+// requests made to RedirectPort to HTTPS
+type Listener struct {
+	Host         string
+	Port         uint64
+	Socket       string // path of a Unix domain socket; overrides Host/Port
+	SocketMode   string // octal permissions of Socket, e.g. 0660
+	TLSCert      string
+	TLSKey       string
+	RedirectPort uint64 // 0 to disable
+}
+
+// certReloader serves a TLS certificate and key pair, reloading them when
+// either file is modified so renewed certificates are used without a restart
+type certReloader struct {
+	sync.Mutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modTime  time.Time // latest modification time of the pair when loaded
+	checked  time.Time
+}
+
+// newCertReloader loads the certificate and key pair at certPath and keyPath
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the most recent modification time of the certificate
+// and key files
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		i, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if i.ModTime().After(latest) {
+			latest = i.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate and key pair; callers hold the lock, or have
+// exclusive access to c
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, reloading the pair if
+// it has changed since it was last loaded; should reloading fail (e.g. the
+// key has been replaced but not yet the certificate), the previous pair
+// continues to be served
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate,
+	error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.checked) < CERT_CHECK {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	if modTime, err := c.latestModTime(); err != nil {
+		log.Printf("checking TLS certificate: %v", err)
+	} else if modTime.After(c.modTime) {
+		if err := c.reload(); err != nil {
+			log.Printf("reloading TLS certificate: %v", err)
+		} else {
+			log.Printf("reloaded TLS certificate %s", c.certPath)
+		}
+	}
+	return c.cert, nil
+}
+
+// listen opens the listener's Unix domain socket or TCP address, replacing a
+// stale socket left behind by a previous instance, but not one still served
+func (l *Listener) listen() (net.Listener, error) {
+	if l.Socket == "" {
+		if net.ParseIP(l.Host) == nil {
+			return nil, errors.New("Host flag could not be parsed; is it an IP address?")
+		}
+		return net.Listen("tcp", net.JoinHostPort(l.Host,
+			strconv.FormatUint(l.Port, 10)))
+	}
+
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("socket mode %q is not an octal file mode",
+			l.SocketMode)
+	}
+	if i, err := os.Lstat(l.Socket); err == nil &&
+		i.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s exists and is not a socket", l.Socket)
+	}
+
+	// the socket is created in a private directory and only moved into place
+	// once its mode is set, so it's never reachable with the permissions the
+	// umask would give it
+	dir, err := ioutil.TempDir(filepath.Dir(l.Socket), ".crane-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// it's the renamed socket which is left behind, to be replaced by the
+	// next instance
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := checkStaleSocket(l.Socket); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, l.Socket); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// checkStaleSocket returns an error unless the socket at path may be replaced,
+// which it may if it doesn't exist or nothing accepts connections on it, e.g.
+// once the instance which created it has exited
+func checkStaleSocket(path string) error {
+	conn, err := net.Dial("unix", path)
+	switch {
+	case err == nil:
+		conn.Close()
+		return fmt.Errorf("listen unix %s: address in use", path)
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ENOENT):
+		return nil
+	}
+	return err
+}
+
+// redirectHandler redirects plain HTTP requests to the same host and path over
+// HTTPS on port
+func redirectHandler(port uint64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		h, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			h = r.Host
+		}
+		if port != 443 {
+			h = net.JoinHostPort(h, strconv.FormatUint(port, 10))
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+h+r.URL.RequestURI(), code)
+	}
+}
+
+// Serve serves handler on the listener until it fails
+func (l *Listener) Serve(handler http.Handler) error {
+	useTLS := l.TLSCert != "" || l.TLSKey != ""
+	if useTLS && (l.TLSCert == "" || l.TLSKey == "") {
+		return errors.New("both -tls-cert and -tls-key are required for TLS")
+	}
+	if l.RedirectPort != 0 && !useTLS {
+		return errors.New("-redirect-port requires -tls-cert and -tls-key")
+	}
+	if l.RedirectPort != 0 && l.Socket != "" {
+		return errors.New("-redirect-port can't be used with -socket")
+	}
+
+	srv := &http.Server{Handler: handler}
+	if useTLS {
+		reloader, err := newCertReloader(l.TLSCert, l.TLSKey)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+	ln, err := l.listen()
+	if err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	if l.Socket != "" {
+		fmt.Printf("Listening on %v (%v)\n", l.Socket, scheme)
+	} else {
+		fmt.Printf("Listening on %v port %v (%v://%v/)\n", l.Host, l.Port,
+			scheme, net.JoinHostPort(l.Host, strconv.FormatUint(l.Port, 10)))
+	}
+
+	if l.RedirectPort != 0 {
+		addr := net.JoinHostPort(l.Host, strconv.FormatUint(l.RedirectPort, 10))
+		fmt.Printf("Redirecting http://%v/ to HTTPS\n", addr)
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, redirectHandler(l.Port)))
+		}()
+	}
+	if useTLS {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
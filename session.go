@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_TTL    time.Duration = 12 * time.Hour // lifetime of a login session
+	SESSION_COOKIE string        = "crane_session"
+	LOGIN_COOKIE   string        = "crane_login" // CSRF token of the login form
+
+	LOGIN_DELAY     time.Duration = time.Second      // wait after a first failed login
+	LOGIN_MAX_DELAY time.Duration = 5 * time.Minute  // longest wait after failed logins
+	LOGIN_FORGET    time.Duration = 15 * time.Minute // failures are forgotten after
+	LOGIN_ADDR_FREE int           = 20               // failures from an address before it must wait
+)
+
+// Session is a login issued to a user by LoginHandler; the CSRF token must
+// accompany every state-changing request made within it
+type Session struct {
+	ID      string
+	Name    string // username; empty when no accounts are configured
+	CSRF    string
+	Expires time.Time
+	User    *User  // resolved per request from Name
+	Token   *Token // set if the request was authenticated by an API token
+}
+
+// Allowed reports whether the session may act on category; sessions
+// authenticated by a token are limited to the token's categories
+func (session *Session) Allowed(category string) bool {
+	return session.Token == nil || session.Token.Allowed(category)
+}
+
+// Sessions is the set of active sessions; session cookies are signed with key,
+// which is generated at startup, so sessions do not survive a restart
+type Sessions struct {
+	sync.Mutex
+	List map[string]*Session
+	key  []byte
+}
+
+var sessions = Sessions{
+	List: make(map[string]*Session),
+	key:  randomBytes(32),
+}
+
+// randomBytes returns n bytes read from crypto/rand, panicking if the system's
+// source of randomness is unavailable
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// randomToken returns a random URL-safe string suitable for session IDs and
+// CSRF tokens
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(32))
+}
+
+// sign returns the cookie value of a session ID: the ID followed by its
+// HMAC-SHA256 signature
+func (s *Sessions) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// New creates a session for the named user and sets its cookie on w
+func (s *Sessions) New(w http.ResponseWriter, r *http.Request,
+	name string) *Session {
+	session := &Session{
+		ID:      randomToken(),
+		Name:    name,
+		CSRF:    randomToken(),
+		Expires: time.Now().Add(SESSION_TTL),
+	}
+	s.Lock()
+	for id, v := range s.List {
+		if time.Now().After(v.Expires) {
+			delete(s.List, id)
+		}
+	}
+	s.List[session.ID] = session
+	s.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    s.sign(session.ID),
+		Path:     basePath + "/",
+		Expires:  session.Expires,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session
+}
+
+// Get returns a copy of the unexpired session identified by the request's
+// cookie, or nil if there is none or its signature is invalid
+func (s *Sessions) Get(r *http.Request) *Session {
+	c, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(s.sign(c.Value[:i])), []byte(c.Value)) {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	session, exists := s.List[c.Value[:i]]
+	if exists == false {
+		return nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.List, session.ID)
+		return nil
+	}
+	v := *session
+	return &v
+}
+
+// Delete ends the request's session, if any, and expires its cookie
+func (s *Sessions) Delete(w http.ResponseWriter, r *http.Request) {
+	if session := s.Get(r); session != nil {
+		s.Lock()
+		delete(s.List, session.ID)
+		s.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    "",
+		Path:     basePath + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// validCSRF reports whether the request carries the session's CSRF token,
+// either as the csrf form value or the X-CSRF-Token header
+func (session *Session) validCSRF(r *http.Request) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.PostFormValue("csrf")
+	}
+	return token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRF)) == 1
+}
+
+// LoginCSRF returns the CSRF token of the login form, issuing a signed cookie
+// holding it if the request doesn't carry one; there's no session yet, so the
+// form's token is checked against the cookie instead
+func (s *Sessions) LoginCSRF(w http.ResponseWriter, r *http.Request) string {
+	if token := s.loginToken(r); token != "" {
+		return token
+	}
+	token := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     LOGIN_COOKIE,
+		Value:    s.sign(token),
+		Path:     basePath + "/login",
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// loginToken returns the token of the request's login cookie, or an empty
+// string if there is none or its signature is invalid
+func (s *Sessions) loginToken(r *http.Request) string {
+	c, err := r.Cookie(LOGIN_COOKIE)
+	if err != nil {
+		return ""
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(s.sign(c.Value[:i])), []byte(c.Value)) {
+		return ""
+	}
+	return c.Value[:i]
+}
+
+// validLoginCSRF reports whether the login form submitted carries the token
+// of the request's login cookie
+func (s *Sessions) validLoginCSRF(r *http.Request) bool {
+	token := s.loginToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token),
+		[]byte(r.PostFormValue("csrf"))) == 1
+}
+
+// failures is the record of failed logins from an address, or from an address
+// for a username
+type failures struct {
+	count int
+	last  time.Time // time of the latest failure
+	until time.Time // no attempt is checked before this time
+}
+
+// Backoff delays login attempts after failures, doubling the wait with each
+// failure, after the first Free, from LOGIN_DELAY up to LOGIN_MAX_DELAY
+type Backoff struct {
+	sync.Mutex
+	List map[string]*failures
+	Free int // failures of a key before it must wait
+}
+
+// failed logins are counted for the client's address and the username tried
+// together, so guessing the password of an account is slowed without anyone
+// else being able to lock its owner out; the address alone is counted too,
+// more leniently, so many accounts can't be tried quickly from it either
+var (
+	logins     = Backoff{List: make(map[string]*failures)}
+	addrLogins = Backoff{List: make(map[string]*failures),
+		Free: LOGIN_ADDR_FREE}
+)
+
+// loginKey returns the key of the logins Backoff for attempts from addr for
+// the username name
+func loginKey(addr string, name string) string {
+	return addr + "\x00" + name
+}
+
+// Wait returns how long the keys must wait before another attempt, the
+// longest of their waits
+func (b *Backoff) Wait(keys ...string) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if f, exists := b.List[key]; exists {
+			if d := time.Until(f.until); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt for each of keys
+func (b *Backoff) Fail(keys ...string) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	for key, f := range b.List {
+		if now.Sub(f.last) > LOGIN_FORGET {
+			delete(b.List, key)
+		}
+	}
+	for _, key := range keys {
+		f, exists := b.List[key]
+		if exists == false {
+			f = &failures{}
+			b.List[key] = f
+		}
+		var delay time.Duration
+		if n := f.count - b.Free; n >= 0 {
+			delay = LOGIN_MAX_DELAY
+			if n < 16 && LOGIN_DELAY<<uint(n) < LOGIN_MAX_DELAY {
+				delay = LOGIN_DELAY << uint(n)
+			}
+		}
+		f.count++
+		f.last = now
+		f.until = now.Add(delay)
+	}
+}
+
+// Reset forgets the failed attempts of keys, e.g. of an address for a
+// username once a login for it succeeds
+func (b *Backoff) Reset(keys ...string) {
+	b.Lock()
+	defer b.Unlock()
+	for _, key := range keys {
+		delete(b.List, key)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scopes which may be granted to an API token and the role each confers
+var tokenScopes = map[string]Role{
+	"read":   ROLE_VIEWER,
+	"add":    ROLE_CONTRIBUTOR,
+	"manage": ROLE_ADMIN,
+}
+
+// Token is a personal API token accepted in place of a login session as an
+// "Authorization: Bearer" header; only a digest of its secret is stored
+type Token struct {
+	ID         string
+	Owner      string   // username of the user the token acts as
+	Name       string   // description, e.g. "browser extension"
+	Scopes     []string // read, add and/or manage
+	Categories []string // categories the token is restricted to, if any
+	Created    time.Time
+	Hash       string // hex-encoded SHA-256 digest of the secret
+}
+
+// Role returns the highest role conferred by the token's scopes; the token
+// never grants more than its owner's role
+func (token *Token) Role() Role {
+	var role Role
+	for _, scope := range token.Scopes {
+		if tokenScopes[scope] > role {
+			role = tokenScopes[scope]
+		}
+	}
+	return role
+}
+
+// Allowed reports whether the token may act on category, which it may if it
+// is unrestricted or category is, or is nested beneath, one of its categories
+func (token *Token) Allowed(category string) bool {
+	if len(token.Categories) == 0 {
+		return true
+	}
+	for _, c := range token.Categories {
+		if category == c || strings.HasPrefix(category, c+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens is the set of API tokens, stored one per line in the file at Path as
+// id:owner:name:scopes:categories:created:hash, where name and categories are
+// escaped
+type Tokens struct {
+	sync.RWMutex
+	List map[string]*Token
+	Path string
+}
+
+var tokens = Tokens{List: make(map[string]*Token)}
+
+// Load populates the tokens set from the file at tokens.Path; a missing file
+// is an empty set
+func (tokens *Tokens) Load() error {
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	tokens.List = make(map[string]*Token)
+	f, err := os.Open(tokens.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v := strings.Split(line, ":")
+		if len(v) != 7 {
+			return fmt.Errorf("%s:%d: expected "+
+				"id:owner:name:scopes:categories:created:hash", tokens.Path, n)
+		}
+		token := &Token{ID: v[0], Owner: v[1], Hash: v[6]}
+		if token.Name, err = url.PathUnescape(v[2]); err != nil {
+			return fmt.Errorf("%s:%d: %v", tokens.Path, n, err)
+		}
+		token.Scopes = splitList(v[3])
+		for _, c := range splitList(v[4]) {
+			c, err := url.PathUnescape(c)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", tokens.Path, n, err)
+			}
+			token.Categories = append(token.Categories, c)
+		}
+		created, err := strconv.ParseInt(v[5], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", tokens.Path, n, err)
+		}
+		token.Created = time.Unix(created, 0)
+		tokens.List[token.ID] = token
+	}
+	return s.Err()
+}
+
+// splitList splits a comma-separated list, returning nil for an empty string
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// save writes the tokens set to tokens.Path by way of a temporary file;
+// callers hold the lock
+func (tokens *Tokens) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(tokens.Path), ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, token := range tokens.sorted("") {
+		var categories []string
+		for _, c := range token.Categories {
+			categories = append(categories, url.PathEscape(c))
+		}
+		if _, err := fmt.Fprintf(tmp, "%s:%s:%s:%s:%s:%d:%s\n", token.ID,
+			token.Owner, url.PathEscape(token.Name),
+			strings.Join(token.Scopes, ","), strings.Join(categories, ","),
+			token.Created.Unix(), token.Hash); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), tokens.Path)
+}
+
+// sorted returns the tokens of owner, or every token if owner is empty,
+// ordered by creation; callers hold the lock
+func (tokens *Tokens) sorted(owner string) []*Token {
+	var list []*Token
+	for _, token := range tokens.List {
+		if owner == "" || token.Owner == owner {
+			list = append(list, token)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Sorted returns the tokens of owner, or every token if owner is empty,
+// ordered by creation
+func (tokens *Tokens) Sorted(owner string) []*Token {
+	tokens.RLock()
+	defer tokens.RUnlock()
+	return tokens.sorted(owner)
+}
+
+// hashSecret returns the hex-encoded SHA-256 digest of a token secret; the
+// secrets are random, so a slow password hash isn't warranted
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken creates a token for owner, persisting it to tokens.Path, and
+// returns it along with its secret, which is not stored and can't be
+// recovered
+func (tokens *Tokens) NewToken(owner string, name string, scopes []string,
+	categories []string) (*Token, string, error) {
+	if tokens.Path == "" {
+		return nil, "", errors.New("no tokens file configured (see -tokens)")
+	}
+	if owner == "" {
+		return nil, "", errors.New("tokens require a user account")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if _, exists := tokenScopes[scope]; exists == false {
+			return nil, "", fmt.Errorf("%q is not a valid scope "+
+				"(read, add, manage)", scope)
+		}
+	}
+	id := hex.EncodeToString(randomBytes(8))
+	secret := "crane_" + id + "_" + randomToken()
+	token := &Token{
+		ID:         id,
+		Owner:      owner,
+		Name:       name,
+		Scopes:     scopes,
+		Categories: categories,
+		Created:    time.Now(),
+		Hash:       hashSecret(secret),
+	}
+
+	tokens.Lock()
+	defer tokens.Unlock()
+	tokens.List[id] = token
+	if err := tokens.save(); err != nil {
+		delete(tokens.List, id)
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// RevokeToken deletes a token, persisting the change to tokens.Path; a
+// non-empty owner must match the token's
+func (tokens *Tokens) RevokeToken(id string, owner string) error {
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	token, exists := tokens.List[id]
+	if exists == false || (owner != "" && token.Owner != owner) {
+		return fmt.Errorf("token %q does not exist", id)
+	}
+	delete(tokens.List, id)
+	return tokens.save()
+}
+
+// Authenticate returns the token matching secret, or nil
+func (tokens *Tokens) Authenticate(secret string) *Token {
+	v := strings.SplitN(strings.TrimPrefix(secret, "crane_"), "_", 2)
+	if len(v) != 2 {
+		return nil
+	}
+	tokens.RLock()
+	token, exists := tokens.List[v[0]]
+	tokens.RUnlock()
+	if exists == false || subtle.ConstantTimeCompare([]byte(token.Hash),
+		[]byte(hashSecret(secret))) != 1 {
+		return nil
+	}
+	return token
+}
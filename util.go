@@ -2,40 +2,58 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/html"
 )
 
-var privateIPBlocks []*net.IPNet
+var (
+	privateIPBlocks []*net.IPNet
+	privateIPOnce   sync.Once
+)
 
-// isPrivateIP checks to if the provided IP address is a loopback, link-local
-// or unique-local address
+// isPrivateIP checks to if the provided IP address is a loopback, link-local,
+// unique-local, shared (CGNAT), multicast or otherwise non-public address,
+// including IPv4 addresses embedded in IPv6 ones (IPv4-mapped, NAT64, 6to4)
 //
 // credit: https://stackoverflow.com/a/50825191
 func isPrivateIP(ip net.IP) bool {
 
-	if privateIPBlocks == nil {
+	privateIPOnce.Do(func() {
 		for _, cidr := range []string{
+			"0.0.0.0/8",      // RFC1122 "this" network
 			"127.0.0.0/8",    // IPv4 loopback
 			"10.0.0.0/8",     // RFC1918
+			"100.64.0.0/10",  // RFC6598 shared address space (CGNAT)
 			"172.16.0.0/12",  // RFC1918
+			"192.0.0.0/24",   // RFC6890 IETF protocol assignments
 			"192.168.0.0/16", // RFC1918
+			"198.18.0.0/15",  // RFC2544 benchmarking
 			"169.254.0.0/16", // RFC3927 link-local
+			"224.0.0.0/4",    // IPv4 multicast
+			"240.0.0.0/4",    // reserved, incl. broadcast
+			"::/128",         // IPv6 unspecified
 			"::1/128",        // IPv6 loopback
 			"fe80::/10",      // IPv6 link-local
 			"fc00::/7",       // IPv6 unique local addr
+			"ff00::/8",       // IPv6 multicast
+			"100::/64",       // RFC6666 discard-only
+			"2001:db8::/32",  // RFC3849 documentation
 		} {
 			_, block, err := net.ParseCIDR(cidr)
 			if err != nil {
@@ -43,8 +61,20 @@ func isPrivateIP(ip net.IP) bool {
 			}
 			privateIPBlocks = append(privateIPBlocks, block)
 		}
+	})
+	if ip == nil {
+		return true
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4 // IPv4-mapped, e.g. ::ffff:127.0.0.1
+	} else if nat64 := (net.IPNet{IP: net.ParseIP("64:ff9b::"),
+		Mask: net.CIDRMask(96, 128)}); nat64.Contains(ip) {
+		return isPrivateIP(net.IP(ip[12:16]))
+	} else if len(ip) == net.IPv6len && ip[0] == 0x20 && ip[1] == 0x02 { // 2002::/16, 6to4
+		return isPrivateIP(net.IP(ip[2:6]))
 	}
-	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
 		return true
 	}
 	for _, block := range privateIPBlocks {
@@ -62,33 +92,43 @@ func getDOIFromBytes(b []byte) []byte {
 	return re.Find(b)
 }
 
-// makeRequest makes a request to a remote resource using the provided
-// *http.Client and returns its *http.Response
-func makeRequest(client *http.Client, u string) (*http.Response, error) {
+// newRequest returns a GET request for a remote resource which looks like it
+// came from a browser
+func newRequest(u string) (*http.Request, error) {
 
 	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	// sciencedirect and company block atypical user agents
 	req.Header.Add("User-Agent", "Mozilla/5.0 (Windows NT 10.0; rv:78.0) Gecko/20100101 Firefox/78.0")
+	return req, nil
+}
+
+// makeRequest makes a request to a remote resource for the named resolver
+// using the provided *http.Client and returns its *http.Response
+func makeRequest(client *http.Client, resolver string,
+	u string) (*http.Response, error) {
 
-	resp, err := client.Do(req)
+	req, err := newRequest(u)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(withResolver(req, resolver))
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%q: status code not OK", u)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%q: %s", u, resp.Status)
 	}
 	return resp, nil
 }
 
-// getMetaFromCitation parses an *http.Response for <meta> tags to populate a
-// paper's Meta attributes and returns the paper
-func getMetaFromCitation(resp *http.Response) (*Meta, error) {
-
-	doc, err := html.Parse(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+// getMetaFromCitation parses a landing page for Highwire citation_* <meta>
+// tags to populate a paper's Meta attributes and returns them
+func getMetaFromCitation(doc *html.Node) *Meta {
 
 	var meta Meta
 	var f func(*html.Node)
@@ -107,37 +147,16 @@ func getMetaFromCitation(resp *http.Response) (*Meta, error) {
 			case "citation_title":
 				meta.Title = cont
 			case "citation_author":
-				var c Contributor
-				// Doe, Jain
-				if strings.Contains(cont, ",") {
-					v := strings.Split(cont, ", ")
-					c.FirstName = strings.Join(v[1:], " ")
-					c.LastName = v[0]
-					// Jain Doe
-				} else {
-					v := strings.Split(cont, " ")
-					c.FirstName = strings.Join(v[:len(v)-1], " ")
-					c.LastName = strings.Join(v[len(v)-1:], " ")
-				}
-				c.Role = "author"
-				if len(meta.Contributors) > 0 {
-					c.Sequence = "additional"
-				} else {
-					c.Sequence = "first"
-				}
-				meta.Contributors = append(meta.Contributors, c)
+				addAuthor(&meta, parseName(cont))
 			case "citation_date", "citation_publication_date":
-				var formats = []string{"2006-01-02", "2006/01/02", "2006"}
-				for _, format := range formats {
-					t, err := time.Parse(format, cont)
-					if err == nil {
-						meta.PubMonth = t.Month().String()
-						meta.PubYear = strconv.Itoa(t.Year())
-						break
-					}
-				}
-			case "citation_journal_title", "og:site_name", "DC.Publisher":
+				setPubDate(&meta, cont)
+			case "citation_journal_title":
 				meta.Journal = cont
+			case "og:site_name":
+				// the journal's title is preferred to the site's name
+				if meta.Journal == "" {
+					meta.Journal = cont
+				}
 			case "citation_firstpage":
 				meta.FirstPage = cont
 			case "citation_lastpage":
@@ -155,7 +174,7 @@ func getMetaFromCitation(resp *http.Response) (*Meta, error) {
 		}
 	}
 	f(doc)
-	return &meta, nil
+	return &meta
 }
 
 // renameFile is an alternative to os.Rename which supports moving files
@@ -214,16 +233,22 @@ func getMetaFromDOI(client *http.Client, doi []byte) (*Meta, error) {
 
 	u := "https://doi.org/" + string(doi)
 	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	req.Header.Add("Accept", "application/vnd.crossref.unixref+xml;q=1,application/rdf+xml;q=0.5")
-	resp, err := client.Do(req)
+	resp, err := client.Do(withResolver(req, RESOLVER_DOI))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%q: failed to get metadata", u)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &InputError{fmt.Errorf("%q: DOI not found", u)}
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%q: failed to get metadata: %s", u,
+			resp.Status)
 	}
 	if resp.Header.Get("Content-Type") != "application/vnd.crossref.unixref+xml" {
 		return nil, fmt.Errorf("%q: content-type not application/vnd.crossref.unixref+xml", u)
@@ -244,25 +269,26 @@ func getMetaFromDOI(client *http.Client, doi []byte) (*Meta, error) {
 }
 
 // getPaper saves makes an outbound request to a remote resource and saves the
-// response body to a temporary file, returning its path, provided the response
-// has the content-type application/pdf
-func getPaper(client *http.Client, scihub *url.URL, resource string) (string, error) {
+// response body to a temporary file, returning its path and provenance,
+// provided the response has the content-type application/pdf and its body is
+// a complete PDF
+func getPaper(client *http.Client, scihub *url.URL, resource string,
+	category string) (string, *Provenance, error) {
 
 	ref, err := url.Parse(resource)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	refURL := scihub.ResolveReference(ref) // scihub + resource
 
-	resp, err := makeRequest(client, refURL.String())
+	resp, err := makeRequest(client, RESOLVER_SCIHUB, refURL.String())
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	defer resp.Body.Close()
-
 	doc, err := html.Parse(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	var directLink *url.URL
@@ -289,44 +315,203 @@ func getPaper(client *http.Client, scihub *url.URL, resource string) (string, er
 	f(doc)
 
 	if directLink == nil || directLink.String() == "" {
-		return "", fmt.Errorf("%q: could not locate PDF link", refURL.String())
+		return "", nil, fmt.Errorf("%q: could not locate PDF link",
+			refURL.String())
 	}
 
-	resp, err = makeRequest(client, directLink.String())
+	resp, err = makeRequest(client, RESOLVER_SCIHUB, directLink.String())
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer resp.Body.Close()
 	if resp.Header.Get("content-type") != "application/pdf" {
-		return "", fmt.Errorf("%q: content-type not application/pdf", refURL.String())
+		return "", nil, fmt.Errorf("%q: content-type not application/pdf",
+			refURL.String())
 	}
 
 	tmpPDF, err := ioutil.TempFile("", "tmp-*.pdf")
 	if err != nil {
+		return "", nil, err
+	}
+	tmpPDF.Close()
+	sum, err := saveRespBody(resp, tmpPDF.Name(), SOURCE_SCIHUB, category)
+	if err != nil {
+		os.Remove(tmpPDF.Name())
+		return "", nil, err
+	}
+	prov := &Provenance{
+		Added:  time.Now(),
+		Source: SOURCE_SCIHUB,
+		URL:    resp.Request.URL.String(),
+		SHA256: sum,
+	}
+	return tmpPDF.Name(), prov, nil
+}
+
+// saveRespBody writes the body of resp, a paper being downloaded into
+// category, to path, returning the hex-encoded SHA-256 digest of the written
+// body. The body is staged in stagingDir, where, if the server supports range
+// requests, an interrupted download is kept and resumed by the next attempt
+func saveRespBody(resp *http.Response, path string, source string,
+	category string) (string, error) {
+
+	u := resp.Request.URL.String()
+	limit := sizeLimit(source)
+	if resp.ContentLength > limit {
+		return "", fmt.Errorf("%q: %d bytes is larger than the %d byte "+
+			"limit", u, resp.ContentLength, limit)
+	}
+
+	// a download whose staged file is claimed by another, of the same URL,
+	// is neither resumed nor staged
+	part := newPartial(resp)
+	if claimPartial(part.path) == false {
+		part.path = ""
+	}
+	defer releasePartial(part.path)
+	body, total := resp.Body, resp.ContentLength
+	var offset int64
+	if n := part.Offset(); n > 0 {
+		// the response is closed first, as it holds one of the requests to
+		// the host permitted at a time
+		resp.Body.Close()
+		r, err := part.Resume(n)
+		if err != nil {
+			return "", err
+		}
+		defer r.Body.Close()
+		body, total = r.Body, r.ContentLength
+		if r.StatusCode == http.StatusPartialContent {
+			if offset = n; total >= 0 {
+				total += n
+			}
+		} else {
+			part.Restart(r)
+		}
+	}
+	stage := path
+	var out *os.File
+	var err error
+	if part.Resumable() {
+		stage = part.path
+		out, err = part.Stage(offset)
+	} else {
+		out, err = os.Create(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	// the digest covers the bytes staged by earlier attempts too
+	h := sha256.New()
+	if offset > 0 {
+		f, err := os.Open(stage)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dl := downloads.start(resp, source, category, offset, total)
+	defer downloads.finish(dl)
+
+	r := http.MaxBytesReader(nil, body, limit-offset)
+	n, err := io.Copy(io.MultiWriter(out, h, dl), r)
+	n += offset
+
+	// the validators of a file started afresh are recorded once its bytes
+	// are written, whether or not the download completed
+	if part.Resumable() && offset == 0 && n > 0 {
+		if rerr := part.Record(); rerr != nil {
+			log.Printf("%q: recording download for resumption: %v", u, rerr)
+		}
+	}
+	kept := ""
+	if part.Resumable() && n > 0 {
+		kept = "; retry to resume"
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return "", fmt.Errorf("%q: download stalled after %d bytes, nothing "+
+			"received for %v%s", u, n, idleTimeout, kept)
+	} else if err != nil && n >= limit {
+		part.Discard()
+		return "", fmt.Errorf("%q: larger than the %d byte limit", u, limit)
+	} else if err != nil {
+		return "", fmt.Errorf("%q: download interrupted after %d bytes: %v%s",
+			u, n, err, kept)
+	}
+	if total >= 0 && n != total {
+		return "", fmt.Errorf("%q: truncated download, received %d of %d "+
+			"bytes%s", u, n, total, kept)
+	}
+	if err := out.Close(); err != nil {
 		return "", err
 	}
-	if err := saveRespBody(resp, tmpPDF.Name()); err != nil {
+	if err := validatePDF(stage); err != nil {
+		part.Discard()
+		return "", fmt.Errorf("%q: %v", u, err)
+	}
+	if stage != path {
+		if err := renameFile(stage, path); err != nil {
+			return "", err
+		}
+		part.Discard()
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the hex-encoded SHA-256 digest of the file at path
+func hashFile(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
 		return "", err
 	}
-	if err := tmpPDF.Close(); err != nil {
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
-	return tmpPDF.Name(), nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// saveRespBody writes the provided http.Response to path
-func saveRespBody(resp *http.Response, path string) error {
+// writeMeta encodes meta as XML to path by way of a temporary file in the
+// same directory, renamed over path so it's never left partly written
+func writeMeta(meta *Meta, path string) error {
 
-	out, err := os.Create(path)
+	// hidden, so it's skipped should the library be walked meanwhile
+	tmpXML, err := ioutil.TempFile(filepath.Dir(path), ".tmp-*.meta.xml")
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer os.Remove(tmpXML.Name())
 
-	r := http.MaxBytesReader(nil, resp.Body, MAX_SIZE)
-	_, err = io.Copy(out, r)
-	if err != nil {
+	// TempFile creates files readable only by their owner
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmpXML.Chmod(mode); err != nil {
+		tmpXML.Close()
 		return err
 	}
-	return nil
+	e := xml.NewEncoder(tmpXML)
+	if err := e.Encode(meta); err != nil {
+		tmpXML.Close()
+		return err
+	}
+	if err := tmpXML.Sync(); err != nil {
+		tmpXML.Close()
+		return err
+	}
+	if err := tmpXML.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpXML.Name(), path)
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// QUARANTINE_DIR is the hidden directory of papers.Path to which Repair moves
+// bad files, preserving their paths relative to papers.Path
+const QUARANTINE_DIR = ".quarantine"
+
+// kinds of Problem found by Verify
+const (
+	PROBLEM_MISSING   = "missing"         // paper in the set, but not on disk
+	PROBLEM_EMPTY     = "empty"           // zero-byte PDF or sidecar
+	PROBLEM_NOT_PDF   = "not-pdf"         // e.g. an HTML error page
+	PROBLEM_TRUNCATED = "truncated"       // PDF without its trailer
+	PROBLEM_ORPHAN    = "orphan-sidecar"  // sidecar without a PDF
+	PROBLEM_BAD_META  = "bad-sidecar"     // sidecar which fails XML decoding
+	PROBLEM_DIGEST    = "digest-mismatch" // PDF no longer matches its digest
+	PROBLEM_NO_DIGEST = "no-digest"       // PDF without a recorded digest
+)
+
+// Problem is an inconsistency in the library found by Verify
+type Problem struct {
+	Path   string // relative to papers.Path, e.g. Mathematics/example2020.pdf
+	Kind   string
+	Reason string
+}
+
+// Repairable reports whether Repair can fix the problem; a digest mismatch
+// can't be, as it's unknown whether the PDF or its digest is at fault
+func (p Problem) Repairable() bool {
+	return p.Kind != PROBLEM_DIGEST
+}
+
+// readHead returns up to the first n bytes of the file at path
+func readHead(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(io.LimitReader(f, n))
+}
+
+// Notice reports whether the problem is informational rather than an
+// inconsistency, e.g. a PDF added by other means which has no digest recorded
+func (p Problem) Notice() bool {
+	return p.Kind == PROBLEM_NO_DIGEST
+}
+
+// Verify checks the files of papers.Path directly, rather than the papers.List
+// set, so problems which would prevent the set from being populated are found
+// too; problems are returned ordered by path
+func (papers *Papers) Verify() []Problem {
+	var problems []Problem
+	filepath.Walk(papers.Path, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			problems = append(problems, papers.checkFile(path, info,
+				err)...)
+			return nil
+		}
+		if path != papers.Path && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() == false {
+			problems = append(problems, papers.checkFile(path, info,
+				nil)...)
+		}
+		return nil
+	})
+
+	// papers of the set whose PDFs have since been removed from disk
+	papers.RLock()
+	for _, set := range papers.List {
+		for key, paper := range set {
+			if _, err := os.Stat(paper.PaperPath); os.IsNotExist(err) {
+				problems = append(problems, Problem{key, PROBLEM_MISSING,
+					"PDF no longer exists"})
+			}
+		}
+	}
+	papers.RUnlock()
+
+	sortProblems(problems)
+	return problems
+}
+
+// VerifyPaths checks the files at paths, relative to papers.Path, as Verify
+// checks the whole library, e.g. once they've been repaired; problems are
+// returned ordered by path
+func (papers *Papers) VerifyPaths(paths []string) []Problem {
+	var problems []Problem
+	for _, path := range paths {
+		abs := filepath.Join(papers.Path, path)
+		info, err := os.Stat(abs)
+		if err == nil || os.IsNotExist(err) == false {
+			problems = append(problems, papers.checkFile(abs, info, err)...)
+			continue
+		}
+		papers.RLock()
+		_, exists := papers.List[filepath.Dir(path)][path]
+		papers.RUnlock()
+		if exists {
+			problems = append(problems, Problem{path, PROBLEM_MISSING,
+				"PDF no longer exists"})
+		}
+	}
+	sortProblems(problems)
+	return problems
+}
+
+// sortProblems orders problems by path
+func sortProblems(problems []Problem) {
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+}
+
+// checkFile returns the problems of the file at path, whose info and error
+// are as passed to a WalkFunc
+func (papers *Papers) checkFile(path string, info os.FileInfo,
+	err error) []Problem {
+	rel, _ := filepath.Rel(papers.Path, path)
+	problem := func(kind string, reason string) []Problem {
+		return []Problem{{rel, kind, reason}}
+	}
+	if err != nil {
+		return problem(PROBLEM_MISSING, err.Error())
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".meta.xml"):
+		pdf := strings.TrimSuffix(path, ".meta.xml") + ".pdf"
+		if _, err := os.Stat(pdf); os.IsNotExist(err) {
+			return problem(PROBLEM_ORPHAN, "sidecar has no PDF")
+		} else if info.Size() == 0 {
+			return problem(PROBLEM_EMPTY, "sidecar is empty")
+		} else if _, err := readMeta(path); err != nil {
+			return problem(PROBLEM_BAD_META, err.Error())
+		}
+	case filepath.Ext(path) == ".pdf":
+		if info.Size() == 0 {
+			return problem(PROBLEM_EMPTY, "PDF is empty")
+		}
+		b, err := readHead(path, PDF_HEAD)
+		if err != nil {
+			return problem(PROBLEM_MISSING, err.Error())
+		}
+		if err := checkPDFHeader(b); err != nil {
+			return problem(PROBLEM_NOT_PDF, err.Error())
+		}
+		if b, err = readTail(path, PDF_TAIL); err != nil {
+			return problem(PROBLEM_MISSING, err.Error())
+		}
+		if err := checkPDFTrailer(b); err != nil {
+			return problem(PROBLEM_TRUNCATED, err.Error())
+		}
+		// an undecodable sidecar is reported by itself
+		meta, err := readMeta(strings.TrimSuffix(path, ".pdf") + ".meta.xml")
+		if err != nil && os.IsNotExist(err) == false {
+			return nil
+		}
+		if meta == nil || meta.Provenance == nil ||
+			meta.Provenance.SHA256 == "" {
+			return problem(PROBLEM_NO_DIGEST, "no SHA-256 digest recorded; "+
+				"repair records it in the sidecar")
+		}
+		if sum, err := hashFile(path); err != nil {
+			return problem(PROBLEM_MISSING, err.Error())
+		} else if sum != meta.Provenance.SHA256 {
+			return problem(PROBLEM_DIGEST, "SHA-256 digest "+sum+
+				" does not match "+meta.Provenance.SHA256+
+				" recorded at download")
+		}
+	}
+	return nil
+}
+
+// readMeta decodes the XML sidecar at path
+func readMeta(path string) (*Meta, error) {
+	var meta Meta
+	if err := decodeMeta(path, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// quarantine moves the file at path, relative to papers.Path, to the same
+// path beneath QUARANTINE_DIR, returning its new path
+func (papers *Papers) quarantine(path string) (string, error) {
+	dest := filepath.Join(papers.Path, QUARANTINE_DIR, path)
+	if _, err := os.Stat(dest); err == nil {
+		dest = fmt.Sprintf("%s.%d", dest, time.Now().UnixNano())
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(papers.Path, path), dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// dropPaper removes the paper whose PDF is at path, relative to papers.Path,
+// from the papers.List set, reporting whether it was there
+func (papers *Papers) dropPaper(path string) bool {
+	papers.Lock()
+	defer papers.Unlock()
+	paper, exists := papers.List[filepath.Dir(path)][path]
+	if exists {
+		papers.unindex(path, paper)
+		delete(papers.List[filepath.Dir(path)], path)
+	}
+	return exists
+}
+
+// dropMeta clears the metadata of the paper whose sidecar is at path, relative
+// to papers.Path, in the papers.List set
+func (papers *Papers) dropMeta(path string) {
+	papers.Lock()
+	defer papers.Unlock()
+	key := strings.TrimSuffix(path, ".meta.xml") + ".pdf"
+	if paper, exists := papers.List[filepath.Dir(path)][key]; exists {
+		papers.unindex(key, paper)
+		paper.Meta = Meta{}
+		paper.MetaPath = ""
+		papers.index(key, paper)
+	}
+}
+
+// Repair fixes a problem found by Verify, returning a description of what was
+// done: bad files are moved to QUARANTINE_DIR (along with the sidecar of a bad
+// PDF), undecodable sidecars are regenerated from doi.org if a DOI can be
+// found in them, or otherwise quarantined, and missing digests are recorded in
+// the PDF's sidecar, which is created if need be
+func (papers *Papers) Repair(p Problem) (string, error) {
+	if !p.Repairable() {
+		return "", fmt.Errorf("%s problems can't be repaired automatically",
+			p.Kind)
+	}
+	defer papers.clearLoadErrors(p.Path)
+	abs := filepath.Join(papers.Path, p.Path)
+
+	switch {
+	case p.Kind == PROBLEM_MISSING:
+		// files which exist but couldn't be read (e.g. for their
+		// permissions) are left for the admin to fix
+		if _, err := os.Stat(abs); os.IsNotExist(err) == false {
+			return "", fmt.Errorf("%s exists but can't be read; check its "+
+				"permissions", p.Path)
+		}
+		if papers.dropPaper(p.Path) == false {
+			return "already absent from the library", nil
+		}
+		return "removed from the library", nil
+
+	case p.Kind == PROBLEM_NO_DIGEST:
+		metaPath := strings.TrimSuffix(abs, ".pdf") + ".meta.xml"
+		meta, err := readMeta(metaPath)
+		if os.IsNotExist(err) {
+			meta, err = &Meta{}, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		sum, err := hashFile(abs)
+		if err != nil {
+			return "", err
+		}
+		if meta.Provenance == nil {
+			meta.Provenance = &Provenance{}
+		}
+		meta.Provenance.SHA256 = sum
+		if err := writeMeta(meta, metaPath); err != nil {
+			return "", err
+		}
+		if err := papers.reloadPaper(p.Path); err != nil {
+			return "", fmt.Errorf("digest recorded, but %s couldn't be "+
+				"reloaded: %v", p.Path, err)
+		}
+		return "recorded digest " + sum, nil
+
+	case p.Kind == PROBLEM_BAD_META:
+		b, err := ioutil.ReadFile(abs)
+		if err != nil {
+			return "", err
+		}
+		doi := getDOIFromBytes(b)
+		if doi == nil {
+			err = errors.New("no DOI found")
+		} else {
+			var meta *Meta
+			if meta, err = getMetaFromDOI(client, doi); err == nil {
+				err = writeMeta(meta, abs)
+			}
+		}
+		if err == nil {
+			pdf := strings.TrimSuffix(p.Path, ".meta.xml") + ".pdf"
+			if err := papers.reloadPaper(pdf); err != nil {
+				return "", fmt.Errorf("regenerated from doi.org (%s), but "+
+					"%s couldn't be reloaded: %v", doi, pdf, err)
+			}
+			return fmt.Sprintf("regenerated from doi.org (%s)", doi), nil
+		}
+		dest, qerr := papers.quarantine(p.Path)
+		if qerr != nil {
+			return "", qerr
+		}
+		papers.dropMeta(p.Path)
+		return fmt.Sprintf("quarantined to %s (not regenerated: %v)", dest,
+			err), nil
+
+	case strings.HasSuffix(p.Path, ".meta.xml"):
+		dest, err := papers.quarantine(p.Path)
+		if err != nil {
+			return "", err
+		}
+		papers.dropMeta(p.Path)
+		return "quarantined to " + dest, nil
+
+	default:
+		dest, err := papers.quarantine(p.Path)
+		if err != nil {
+			return "", err
+		}
+		papers.dropPaper(p.Path)
+		meta := strings.TrimSuffix(p.Path, ".pdf") + ".meta.xml"
+		if _, err := os.Stat(filepath.Join(papers.Path, meta)); err == nil {
+			if _, err := papers.quarantine(meta); err != nil {
+				return "", err
+			}
+		}
+		return "quarantined to " + dest, nil
+	}
+}
+
+// reloadPaper reads the paper whose PDF is at path, relative to papers.Path,
+// into the papers.List set again, e.g. once its sidecar has been replaced
+func (papers *Papers) reloadPaper(path string) error {
+	abs := filepath.Join(papers.Path, path)
+	info, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	return papers.findPapersWalk(abs, info, nil)
+}